@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// reconnectBudget allows at most max reconnects within a sliding window, so
+// an occasional blip is tolerated but a flapping connection is not
+type reconnectBudget struct {
+	max    int
+	window time.Duration
+	times  []time.Time
+}
+
+// newReconnectBudget creates a budget of max reconnects per window. A zero
+// max never runs out.
+func newReconnectBudget(max int, window time.Duration) *reconnectBudget {
+	return &reconnectBudget{max: max, window: window}
+}
+
+// spend records a reconnect and reports whether the budget still allows it
+func (b *reconnectBudget) spend(now time.Time) bool {
+	if b.max <= 0 {
+		return true
+	}
+
+	cutoff := now.Add(-b.window)
+	kept := b.times[:0]
+	for _, t := range b.times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.times = append(kept, now)
+	return len(b.times) <= b.max
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// chunkEnvelope is the wrapper a server uses to split one large JSON-RPC
+// message across several SSE message events:
+//
+//	{"arcpointChunk": {"id": 7, "index": 0, "final": false, "data": "..."}}
+//
+// The data fields, concatenated in index order, form the original message.
+type chunkEnvelope struct {
+	Chunk *struct {
+		ID    json.RawMessage `json:"id"`
+		Index int             `json:"index"`
+		Final bool            `json:"final"`
+		Data  string          `json:"data"`
+	} `json:"arcpointChunk"`
+}
+
+// chunkSetTimeout is how long a chunked message may take to complete
+// before its chunks are discarded, so sets whose remaining chunks were lost
+// don't accumulate
+const chunkSetTimeout = 2 * time.Minute
+
+// partialMessage holds the chunks received so far for one request id
+type partialMessage struct {
+	chunks  map[int]string
+	size    int64
+	total   int // number of chunks, known once the final chunk arrives
+	started time.Time
+}
+
+// chunkReassembler buffers chunked messages keyed by request id
+type chunkReassembler struct {
+	maxBytes int64
+	clock    clock
+	mu       sync.Mutex
+	pending  map[string]*partialMessage
+}
+
+// newChunkReassembler creates a reassembler that refuses messages larger
+// than maxBytes
+func newChunkReassembler(maxBytes int64, clk clock) *chunkReassembler {
+	return &chunkReassembler{
+		maxBytes: maxBytes,
+		clock:    clk,
+		pending:  make(map[string]*partialMessage),
+	}
+}
+
+// Accept inspects an SSE message. Messages that aren't chunk envelopes are
+// returned unchanged. Chunks are buffered and nil is returned until the
+// final piece completes the message, which is then returned whole.
+func (r *chunkReassembler) Accept(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(`"arcpointChunk"`)) {
+		return data, nil
+	}
+
+	var env chunkEnvelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Chunk == nil {
+		// Not actually an envelope, forward as-is
+		return data, nil
+	}
+	chunk := env.Chunk
+	key := string(chunk.ID)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	r.evictStale(now)
+	msg := r.pending[key]
+	if msg == nil {
+		msg = &partialMessage{chunks: make(map[int]string), started: now}
+		r.pending[key] = msg
+	}
+	if err := msg.validIndex(chunk.Index, chunk.Final); err != nil {
+		delete(r.pending, key)
+		return nil, fmt.Errorf("chunked message for id %s: %w", key, err)
+	}
+	if _, dup := msg.chunks[chunk.Index]; !dup {
+		msg.chunks[chunk.Index] = chunk.Data
+		msg.size += int64(len(chunk.Data))
+	}
+	if chunk.Final {
+		msg.total = chunk.Index + 1
+	}
+
+	if msg.size > r.maxBytes {
+		delete(r.pending, key)
+		return nil, fmt.Errorf("chunked message for id %s exceeded %d bytes", key, r.maxBytes)
+	}
+
+	if msg.total == 0 || len(msg.chunks) < msg.total {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(msg.size))
+	for i := 0; i < msg.total; i++ {
+		part, ok := msg.chunks[i]
+		if !ok {
+			delete(r.pending, key)
+			return nil, fmt.Errorf("chunked message for id %s is missing chunk %d", key, i)
+		}
+		buf.WriteString(part)
+	}
+	delete(r.pending, key)
+	debugf("Reassembled chunked result for id %s: %d chunks, %d bytes in %s", key, msg.total, msg.size, now.Sub(msg.started).Round(time.Millisecond))
+	return buf.Bytes(), nil
+}
+
+// validIndex checks a chunk's index against those already received: it
+// must be at least 0 and below the total once the final chunk has given it,
+// and a final chunk can't come before an index already seen
+func (m *partialMessage) validIndex(index int, final bool) error {
+	if index < 0 {
+		return fmt.Errorf("negative chunk index %d", index)
+	}
+	if m.total > 0 && (index >= m.total || (final && index != m.total-1)) {
+		return fmt.Errorf("chunk index %d is outside the %d chunks announced", index, m.total)
+	}
+	if final {
+		for seen := range m.chunks {
+			if seen > index {
+				return fmt.Errorf("final chunk %d arrived after chunk %d", index, seen)
+			}
+		}
+	}
+	return nil
+}
+
+// evictStale discards chunk sets that have been incomplete for longer than
+// chunkSetTimeout. r.mu must be held.
+func (r *chunkReassembler) evictStale(now time.Time) {
+	for key, msg := range r.pending {
+		if now.Sub(msg.started) > chunkSetTimeout {
+			log.Printf("Discarding chunked message for id %s: %d chunks received, incomplete after %s", key, len(msg.chunks), chunkSetTimeout)
+			delete(r.pending, key)
+		}
+	}
+}
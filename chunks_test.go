@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func chunk(index int, final bool, data string) []byte {
+	return []byte(fmt.Sprintf(`{"arcpointChunk":{"id":7,"index":%d,"final":%t,"data":%q}}`, index, final, data))
+}
+
+func TestChunksReassembleInAnyOrder(t *testing.T) {
+	r := newChunkReassembler(1<<20, newFakeClock())
+	for _, data := range [][]byte{chunk(1, true, `"id":7}`), chunk(0, false, `{"jsonrpc":"2.0",`)} {
+		got, err := r.Accept(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			if string(got) != `{"jsonrpc":"2.0","id":7}` {
+				t.Fatalf("reassembled %s", got)
+			}
+			return
+		}
+	}
+	t.Fatal("message was never completed")
+}
+
+func TestChunksRejectInvalidIndexes(t *testing.T) {
+	cases := map[string][][]byte{
+		"negative":          {chunk(-1, false, "x")},
+		"past final":        {chunk(1, true, "x"), chunk(2, false, "y")},
+		"final before seen": {chunk(3, false, "x"), chunk(1, true, "y")},
+		"second final":      {chunk(2, true, "x"), chunk(1, true, "y")},
+	}
+	for name, chunks := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newChunkReassembler(1<<20, newFakeClock())
+			var err error
+			for _, data := range chunks {
+				if _, err = r.Accept(data); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Fatal("invalid chunk was accepted")
+			}
+			if len(r.pending) != 0 {
+				t.Fatalf("%d chunk sets left buffered after the error", len(r.pending))
+			}
+		})
+	}
+}
+
+func TestChunksEvictIncompleteSets(t *testing.T) {
+	captureLog(t)
+	clk := newFakeClock()
+	r := newChunkReassembler(1<<20, clk)
+	if _, err := r.Accept(chunk(0, false, "lost")); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(chunkSetTimeout + time.Second)
+	got, err := r.Accept(chunk(1, true, `{"jsonrpc":"2.0","id":7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatalf("stale chunk was joined to a later one: %s", got)
+	}
+	if _, ok := r.pending["7"].chunks[0]; ok {
+		t.Fatal("stale chunk set was not evicted")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the client's source of time. Timing-dependent code goes through
+// it so tests can inject a fake clock instead of really sleeping.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a timer started by clock.AfterFunc
+type clockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// sleep waits for d or until ctx is cancelled
+func (c *SSEClient) sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-c.clock.After(d):
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when a test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// started receives the duration of each timer as it is started
+	started chan time.Duration
+}
+
+// fakeTimer is a timer on a fakeClock, firing f or sending on ch
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	f      func()
+	ch     chan time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), started: make(chan time.Duration, 64)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(&fakeTimer{clock: c, ch: ch}, d)
+	return ch
+}
+
+// Sleep returns at once after advancing the clock by d
+func (c *fakeClock) Sleep(d time.Duration) { c.Advance(d) }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := &fakeTimer{clock: c, f: f}
+	c.add(t, d)
+	return t
+}
+
+func (c *fakeClock) add(t *fakeTimer, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.when = c.now.Add(d)
+	t.active = true
+	c.timers = append(c.timers, t)
+	select {
+	case c.started <- d:
+	default:
+	}
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeTimer
+	kept := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case !t.active:
+		case !t.when.After(now):
+			t.active = false
+			due = append(due, t)
+		default:
+			kept = append(kept, t)
+		}
+	}
+	c.timers = kept
+	c.mu.Unlock()
+
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+		} else {
+			t.ch <- now
+		}
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	was := t.Stop()
+	t.clock.add(t, d)
+	return was
+}
@@ -0,0 +1,989 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Config holds optional client behaviour read from the environment
+type Config struct {
+	// Transport selects the wire protocol: "sse" or "streamable-http"
+	Transport string
+	// Streams are the SSE stream paths to open, "/sse" unless
+	// ARCPOINT_STREAMS lists several
+	Streams []string
+	// MCPPath is the Streamable HTTP endpoint path
+	MCPPath string
+	// SessionHeader, if set, carries the SSE session id on message POSTs
+	// instead of the sessionId query parameter
+	SessionHeader string
+	// DeleteSessionOnExit sends a DELETE for the Streamable HTTP session
+	// on graceful shutdown
+	DeleteSessionOnExit bool
+	// Quiet suppresses all non-fatal logging, overriding LogLevel
+	Quiet bool
+	// LogLevel is "info" (default) or "debug"
+	LogLevel string
+	// InstanceLabel tags every log line, so several instances sharing a
+	// host can be told apart
+	InstanceLabel string
+	// InstanceHeader sends InstanceLabel as X-Arcpoint-Instance
+	InstanceHeader bool
+	// ConnectionName is sent as X-Connection-Name on the SSE GET so the
+	// server can label the session for operators
+	ConnectionName string
+	// LogFullSession logs whole session ids instead of a short prefix
+	LogFullSession bool
+	// LogFile, if set, receives log output instead of stderr
+	LogFile string
+	// KeepalivePostInterval is how often a no-op POST is sent to keep the
+	// message connection pool warm (0 disables it)
+	KeepalivePostInterval time.Duration
+	// KeepalivePostPath is the path the keepalive POST is sent to
+	KeepalivePostPath string
+	// HostKeepaliveInterval is how long stdout may stay quiet before a
+	// heartbeat notification is written to the host (0 disables it)
+	HostKeepaliveInterval time.Duration
+	// EchoStdinKeepalive answers a blank stdin line with a keepalive
+	// notification on stdout
+	EchoStdinKeepalive bool
+	// LocalAddr is the local address outgoing connections are bound to
+	LocalAddr *net.TCPAddr
+	// AllowInsecureHTTP permits plain http URLs that aren't on localhost
+	AllowInsecureHTTP bool
+	// FallbackURL, if set, is a secondary backend used while the primary
+	// is unreachable
+	FallbackURL string
+	// FailoverAfter is how many consecutive failed connection attempts
+	// switch to the other backend
+	FailoverAfter int
+	// FailbackInterval is how often the primary is checked while on the
+	// fallback
+	FailbackInterval time.Duration
+	// Proxy, if set, is the proxy all requests go through, including any
+	// credentials from ARCPOINT_PROXY_USER and ARCPOINT_PROXY_PASS
+	Proxy *url.URL
+	// Preflight checks PreflightPath before the first SSE connection
+	Preflight bool
+	// PreflightPath is the health path the preflight check requests
+	PreflightPath string
+	// IdleTimeout reconnects the SSE stream after this long without any
+	// activity (0 disables it). Each connection applies ±10% jitter.
+	IdleTimeout time.Duration
+	// MaxConnectionAge reconnects the SSE stream once it has been open this
+	// long, regardless of activity
+	MaxConnectionAge time.Duration
+	// ShortConnectionDelay, if longer than the usual delay, is waited
+	// before reconnecting while the server keeps closing streams soon
+	// after they open
+	ShortConnectionDelay time.Duration
+	// ChaosReconnectInterval deliberately tears down the SSE stream this
+	// often, for exercising reconnects in testing (0 disables it)
+	ChaosReconnectInterval time.Duration
+	// OnReconnectCmd is a shell command run in the background whenever the
+	// SSE stream reconnects
+	OnReconnectCmd string
+	// MaxLifetime shuts the client down cleanly once the process has run
+	// this long (0 disables it)
+	MaxLifetime time.Duration
+	// LifetimeWarning is how long before MaxLifetime the shutdown is logged
+	LifetimeWarning time.Duration
+	// ReconnectOnVersionChange reconnects the SSE stream when the server
+	// advertises a different version than before
+	ReconnectOnVersionChange bool
+	// FailureLogInterval is how often repeated connection failures are
+	// summarised once they stop being logged individually
+	FailureLogInterval time.Duration
+	// EndpointTimeout reconnects if no endpoint event arrives this long
+	// after connecting (0 disables it)
+	EndpointTimeout time.Duration
+	// EndpointColdStartTimeout replaces EndpointTimeout on reconnects after
+	// a prolonged outage, until a session is established again
+	EndpointColdStartTimeout time.Duration
+	// StrictEndpoint exits instead of waiting for a usable endpoint event
+	// when the server sends a malformed one
+	StrictEndpoint bool
+	// InitialConnectRetries bounds retries, after the first attempt, to
+	// reach the backend at startup before giving up (0 retries forever)
+	InitialConnectRetries int
+	// UnboundedStdin reads host messages of any size, limited only by
+	// memory
+	UnboundedStdin bool
+	// IdleStdinTimeout shuts the client down if the host sends nothing
+	// this long after the session is ready (0 waits forever)
+	IdleStdinTimeout time.Duration
+	// AllowNoStdin keeps the client running when stdin is already closed
+	// at startup, to consume the SSE stream only
+	AllowNoStdin bool
+	// SkipEOFWait shuts down as soon as stdin closes, without waiting for
+	// responses to requests already sent
+	SkipEOFWait bool
+	// StreamDecode frames stdin with a JSON decoder instead of by line
+	StreamDecode bool
+	// MaxReconnects is how many reconnects are allowed within
+	// ReconnectWindow before the client gives up (0 never gives up)
+	MaxReconnects   int
+	ReconnectWindow time.Duration
+	// AllowedMethods, if set, are the only methods proxied from the host
+	AllowedMethods map[string]bool
+	// BlockedMethods are never proxied from the host
+	BlockedMethods map[string]bool
+	// ContentType is the Content-Type of message POSTs
+	ContentType string
+	// DeclareSize sends X-Arcpoint-Payload-Bytes on message POSTs for
+	// gateways that meter by declared size
+	DeclareSize bool
+	// MethodHeaders adds extra headers to message POSTs by JSON-RPC method
+	MethodHeaders map[string]map[string]string
+	// PostRetries is how many times a failed message POST is retried
+	PostRetries int
+	// PostRetryBase, PostRetryMax and PostRetryMultiplier shape the backoff
+	// between POST retries, separately from SSE reconnects
+	PostRetryBase       time.Duration
+	PostRetryMax        time.Duration
+	PostRetryMultiplier float64
+	// RetryableStatus lists extra HTTP statuses that trigger a retry
+	RetryableStatus map[int]bool
+	// Tracing generates a W3C traceparent for messages that don't carry one
+	Tracing bool
+	// RewriteIDs maps host request ids to unique internal ids on the wire
+	RewriteIDs bool
+	// SendClientEnv adds OS, architecture and hostname to initialize
+	SendClientEnv bool
+	// ResponseTimeout fails requests whose response hasn't arrived in time
+	// (0 waits forever)
+	ResponseTimeout time.Duration
+	// InitializeTimeout, if set, replaces ResponseTimeout for initialize
+	// requests so a stuck handshake fails fast
+	InitializeTimeout time.Duration
+	// HonorRequestTimeout lets a request override ResponseTimeout with
+	// params._meta.timeoutMs
+	HonorRequestTimeout bool
+	// LateResponseWindow is how long responses to timed out requests are
+	// dropped rather than forwarded
+	LateResponseWindow time.Duration
+	// AnnotateTiming adds each request's round trip to its response as
+	// result._meta.arcpointRttMs
+	AnnotateTiming bool
+	// SurfaceTrace copies a server trace id from _meta to a top-level
+	// arcpointTraceId field on forwarded messages
+	SurfaceTrace bool
+	// QueueSize is how many host messages are held while their stream has
+	// no session (0 sends them straight away)
+	QueueSize int
+	// QueueOverflow is what happens to a message that finds the queue full:
+	// "error", "drop-oldest" or "drop-newest"
+	QueueOverflow string
+	// FlushInterval spaces out the posts of queued messages once their
+	// session arrives (0 sends them back to back)
+	FlushInterval time.Duration
+	// OnDuplicateResponse is "forward" or "drop", for a second response to
+	// a request that was already answered
+	OnDuplicateResponse string
+	// DedupResponses drops SSE messages identical to one forwarded within
+	// DedupWindow
+	DedupResponses bool
+	// DedupWindow is how long forwarded messages are remembered
+	DedupWindow time.Duration
+	// DedupKey is how duplicates are identified, "content" or "event-id"
+	DedupKey string
+	// CoalesceProgress forwards at most one notifications/progress per
+	// ProgressInterval for each progress token
+	CoalesceProgress bool
+	// ProgressInterval is the shortest gap between forwarded updates
+	ProgressInterval time.Duration
+	// MaxResponseBytes caps the size of an immediate message response
+	MaxResponseBytes int64
+	// MaxEventBytes caps the size of a single SSE event
+	MaxEventBytes int64
+	// RawSSE logs every parsed SSE event to stderr for protocol debugging
+	RawSSE bool
+	// ChunkedResults reassembles messages split into arcpointChunk envelopes
+	ChunkedResults bool
+	// ReassembleFragments joins message events that each carry a fragment
+	// of one JSON value
+	ReassembleFragments bool
+	// StatusFile, if set, is rewritten with connection counters and recent
+	// connection events on every transition
+	StatusFile string
+	// EventLogSize is how many recent connection events are retained
+	EventLogSize int
+	// OfflineInit answers initialize locally when the backend can't be
+	// reached
+	OfflineInit bool
+	// ProtocolVersion is reported by a synthetic initialize result when
+	// the host didn't request a version
+	ProtocolVersion string
+	// StrictOutput drops messages from the server that aren't JSON-RPC 2.0
+	// frames instead of forwarding them
+	StrictOutput bool
+	// ResponsesOnly drops server-initiated requests and responses to
+	// requests the host never sent, for hosts without bidirectional support
+	ResponsesOnly bool
+	// RecordPath, if set, receives a recording of the session
+	RecordPath string
+	// ReplayPath, if set, is a recording played back instead of connecting
+	ReplayPath string
+	// SSEDataTrim is how leading whitespace is removed from SSE data
+	// fields: "spec", "all" or "none"
+	SSEDataTrim string
+	// OutputEOL terminates each frame written to stdout
+	OutputEOL string
+	// SanitizeOutput strips a BOM or whitespace before the JSON of each
+	// frame written to stdout
+	SanitizeOutput bool
+	// APITokens, if set, are used instead of a single API token
+	APITokens []string
+	// TokenPolicy chooses among APITokens: "round-robin" or "failover"
+	TokenPolicy string
+	// ByteFidelity forwards server payloads to the host exactly as sent,
+	// turning off every setting that would change them
+	ByteFidelity bool
+	// FidelityBypassed names the settings ByteFidelity turned off
+	FidelityBypassed []string
+	// ShutdownGrace bounds how long shutdown waits for buffered output
+	ShutdownGrace time.Duration
+	// ShutdownHardTimeout is when a stuck shutdown is abandoned with os.Exit
+	ShutdownHardTimeout time.Duration
+}
+
+// defaultShutdownGrace is how long shutdown waits for output to flush
+const defaultShutdownGrace = 5 * time.Second
+
+// defaultShutdownHardTimeout is when a stuck shutdown is forcibly ended
+const defaultShutdownHardTimeout = 10 * time.Second
+
+// defaultReconnectWindow is the sliding window for the reconnect budget
+const defaultReconnectWindow = 10 * time.Minute
+
+// defaultLateResponseWindow is how long late responses are suppressed
+const defaultLateResponseWindow = time.Minute
+
+// defaultMaxResponseBytes is the default cap on immediate message responses
+const defaultMaxResponseBytes = 32 * 1024 * 1024
+
+// Ways ARCPOINT_SSE_DATA_TRIM can remove leading whitespace from SSE data
+const (
+	// sseDataTrimSpec removes a single leading space, per the SSE standard
+	sseDataTrimSpec = "spec"
+	// sseDataTrimAll removes every leading space and tab
+	sseDataTrimAll = "all"
+	// sseDataTrimNone keeps the value exactly as sent
+	sseDataTrimNone = "none"
+)
+
+// Ways ARCPOINT_ON_DUPLICATE_RESPONSE can handle a second response
+const (
+	duplicateForward = "forward"
+	duplicateDrop    = "drop"
+)
+
+// Defaults for the backoff between message POST retries: quick, since
+// POST failures are usually brief blips
+const (
+	defaultPostRetryBase       = 500 * time.Millisecond
+	defaultPostRetryMax        = 10 * time.Second
+	defaultPostRetryMultiplier = 2
+)
+
+// defaultContentType is the default Content-Type of message POSTs
+const defaultContentType = "application/json"
+
+// An outage of at least prolongedOutage means the server may be cold
+// starting, so the endpoint timeout is stretched by coldStartTimeoutFactor
+// unless ARCPOINT_ENDPOINT_COLD_START_TIMEOUT is set
+const (
+	prolongedOutage        = time.Minute
+	coldStartTimeoutFactor = 3
+)
+
+// loadConfig reads optional settings from the environment
+func loadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	if cfg.Quiet, err = envBool("ARCPOINT_QUIET"); err != nil {
+		return cfg, err
+	}
+	cfg.LogLevel = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_LOG_LEVEL")))
+	switch cfg.LogLevel {
+	case "":
+		cfg.LogLevel = "info"
+	case "info", "debug":
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_LOG_LEVEL %q (expected info or debug)", cfg.LogLevel)
+	}
+
+	cfg.LogFile = strings.TrimSpace(os.Getenv("ARCPOINT_LOG_FILE"))
+	if cfg.LogFullSession, err = envBool("ARCPOINT_LOG_FULL_SESSION"); err != nil {
+		return cfg, err
+	}
+	cfg.InstanceLabel = strings.TrimSpace(os.Getenv("ARCPOINT_INSTANCE_LABEL"))
+	if !validHeaderValue(cfg.InstanceLabel) {
+		return cfg, fmt.Errorf("ARCPOINT_INSTANCE_LABEL must not contain line breaks")
+	}
+	if cfg.InstanceHeader, err = envBool("ARCPOINT_INSTANCE_HEADER"); err != nil {
+		return cfg, err
+	}
+	cfg.ConnectionName = strings.TrimSpace(os.Getenv("ARCPOINT_CONNECTION_NAME"))
+	if strings.IndexFunc(cfg.ConnectionName, func(r rune) bool { return r != '\t' && unicode.IsControl(r) }) >= 0 {
+		return cfg, fmt.Errorf("ARCPOINT_CONNECTION_NAME must not contain control characters")
+	}
+
+	cfg.Transport = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_TRANSPORT")))
+	switch cfg.Transport {
+	case "":
+		cfg.Transport = transportSSE
+	case transportSSE, transportStreamableHTTP:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_TRANSPORT %q (expected %s or %s)", cfg.Transport, transportSSE, transportStreamableHTTP)
+	}
+	if cfg.Streams, err = envPaths("ARCPOINT_STREAMS"); err != nil {
+		return cfg, err
+	}
+	if len(cfg.Streams) > 0 && cfg.Transport == transportStreamableHTTP {
+		return cfg, fmt.Errorf("ARCPOINT_STREAMS requires ARCPOINT_TRANSPORT=%s", transportSSE)
+	}
+	if len(cfg.Streams) == 0 {
+		cfg.Streams = []string{"/sse"}
+	}
+	cfg.MCPPath = strings.TrimSpace(os.Getenv("ARCPOINT_MCP_PATH"))
+	if cfg.MCPPath == "" {
+		cfg.MCPPath = "/mcp"
+	} else if !strings.HasPrefix(cfg.MCPPath, "/") {
+		cfg.MCPPath = "/" + cfg.MCPPath
+	}
+	cfg.SessionHeader = strings.TrimSpace(os.Getenv("ARCPOINT_SESSION_HEADER"))
+	if cfg.SessionHeader != "" && !validHeaderName(cfg.SessionHeader) {
+		return cfg, fmt.Errorf("ARCPOINT_SESSION_HEADER is not a valid header name (got %q)", cfg.SessionHeader)
+	}
+	if cfg.DeleteSessionOnExit, err = envBool("ARCPOINT_DELETE_SESSION_ON_EXIT"); err != nil {
+		return cfg, err
+	}
+	if cfg.KeepalivePostInterval, err = envDuration("ARCPOINT_KEEPALIVE_POST_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	cfg.KeepalivePostPath = strings.TrimSpace(os.Getenv("ARCPOINT_KEEPALIVE_POST_PATH"))
+	if cfg.KeepalivePostInterval > 0 {
+		if cfg.KeepalivePostPath == "" {
+			return cfg, fmt.Errorf("ARCPOINT_KEEPALIVE_POST_PATH is required when ARCPOINT_KEEPALIVE_POST_INTERVAL is set")
+		}
+		if !strings.HasPrefix(cfg.KeepalivePostPath, "/") {
+			cfg.KeepalivePostPath = "/" + cfg.KeepalivePostPath
+		}
+	}
+	if cfg.HostKeepaliveInterval, err = envDuration("ARCPOINT_HOST_KEEPALIVE_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	if cfg.EchoStdinKeepalive, err = envBool("ARCPOINT_ECHO_STDIN_KEEPALIVE"); err != nil {
+		return cfg, err
+	}
+
+	if cfg.LocalAddr, err = envLocalAddr("ARCPOINT_LOCAL_ADDR"); err != nil {
+		return cfg, err
+	}
+	if cfg.AllowInsecureHTTP, err = envBool("ARCPOINT_ALLOW_INSECURE_HTTP"); err != nil {
+		return cfg, err
+	}
+	if cfg.FallbackURL, err = envURL("ARCPOINT_API_URL_FALLBACK"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailoverAfter, err = envInt("ARCPOINT_FAILOVER_AFTER", defaultFailoverAfter); err != nil {
+		return cfg, err
+	}
+	if cfg.FailbackInterval, err = envDuration("ARCPOINT_FAILBACK_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailbackInterval == 0 {
+		cfg.FailbackInterval = defaultFailbackInterval
+	}
+	if cfg.Proxy, err = envProxy(); err != nil {
+		return cfg, err
+	}
+	if cfg.Preflight, err = envBool("ARCPOINT_PREFLIGHT"); err != nil {
+		return cfg, err
+	}
+	cfg.PreflightPath = strings.TrimSpace(os.Getenv("ARCPOINT_PREFLIGHT_PATH"))
+	if cfg.PreflightPath == "" {
+		cfg.PreflightPath = "/health"
+	} else if !strings.HasPrefix(cfg.PreflightPath, "/") {
+		cfg.PreflightPath = "/" + cfg.PreflightPath
+	}
+	if cfg.IdleTimeout, err = envDuration("ARCPOINT_IDLE_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConnectionAge, err = envDuration("ARCPOINT_MAX_CONNECTION_AGE"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShortConnectionDelay, err = envDuration("ARCPOINT_SHORT_CONNECTION_DELAY"); err != nil {
+		return cfg, err
+	}
+	if cfg.ChaosReconnectInterval, err = envDuration("ARCPOINT_CHAOS_RECONNECT_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	cfg.OnReconnectCmd = strings.TrimSpace(os.Getenv("ARCPOINT_ON_RECONNECT_CMD"))
+	if cfg.MaxLifetime, err = envDuration("ARCPOINT_MAX_LIFETIME"); err != nil {
+		return cfg, err
+	}
+	if cfg.LifetimeWarning, err = envDuration("ARCPOINT_MAX_LIFETIME_WARNING"); err != nil {
+		return cfg, err
+	}
+	if cfg.LifetimeWarning == 0 {
+		cfg.LifetimeWarning = defaultLifetimeWarning
+	}
+	if cfg.ReconnectOnVersionChange, err = envBool("ARCPOINT_RECONNECT_ON_VERSION_CHANGE"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailureLogInterval, err = envDuration("ARCPOINT_RECONNECT_LOG_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	if cfg.FailureLogInterval == 0 {
+		cfg.FailureLogInterval = defaultFailureLogInterval
+	}
+	if cfg.EndpointTimeout, err = envDuration("ARCPOINT_ENDPOINT_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.EndpointColdStartTimeout, err = envDuration("ARCPOINT_ENDPOINT_COLD_START_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.EndpointColdStartTimeout == 0 {
+		cfg.EndpointColdStartTimeout = coldStartTimeoutFactor * cfg.EndpointTimeout
+	}
+	if cfg.StrictEndpoint, err = envBool("ARCPOINT_STRICT_ENDPOINT"); err != nil {
+		return cfg, err
+	}
+	if cfg.InitialConnectRetries, err = envNonNegInt("ARCPOINT_INITIAL_CONNECT_RETRIES", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.IdleStdinTimeout, err = envDuration("ARCPOINT_IDLE_STDIN_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.AllowNoStdin, err = envBool("ARCPOINT_ALLOW_NO_STDIN"); err != nil {
+		return cfg, err
+	}
+	if cfg.SkipEOFWait, err = envBool("ARCPOINT_SKIP_EOF_WAIT"); err != nil {
+		return cfg, err
+	}
+	if cfg.StreamDecode, err = envBool("ARCPOINT_STREAM_DECODE"); err != nil {
+		return cfg, err
+	}
+	if cfg.UnboundedStdin, err = envBool("ARCPOINT_UNBOUNDED_STDIN"); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxReconnects, err = envNonNegInt("ARCPOINT_MAX_RECONNECTS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ReconnectWindow, err = envDuration("ARCPOINT_RECONNECT_WINDOW"); err != nil {
+		return cfg, err
+	}
+	if cfg.ReconnectWindow == 0 {
+		cfg.ReconnectWindow = defaultReconnectWindow
+	}
+	cfg.AllowedMethods = envSet("ARCPOINT_ALLOWED_METHODS")
+	cfg.BlockedMethods = envSet("ARCPOINT_BLOCKED_METHODS")
+	cfg.ContentType = strings.TrimSpace(os.Getenv("ARCPOINT_CONTENT_TYPE"))
+	if cfg.ContentType == "" {
+		cfg.ContentType = defaultContentType
+	} else if mediaType, _, err := mime.ParseMediaType(cfg.ContentType); err != nil || !strings.Contains(mediaType, "/") {
+		return cfg, fmt.Errorf("invalid ARCPOINT_CONTENT_TYPE %q (expected a media type such as application/json)", cfg.ContentType)
+	}
+	if cfg.DeclareSize, err = envBool("ARCPOINT_DECLARE_SIZE"); err != nil {
+		return cfg, err
+	}
+	if cfg.MethodHeaders, err = envMethodHeaders("ARCPOINT_METHOD_HEADERS"); err != nil {
+		return cfg, err
+	}
+	if cfg.PostRetries, err = envNonNegInt("ARCPOINT_POST_RETRIES", 0); err != nil {
+		return cfg, err
+	}
+	baseMS, err := envInt64("ARCPOINT_POST_RETRY_BASE_MS", defaultPostRetryBase.Milliseconds())
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PostRetryBase = time.Duration(baseMS) * time.Millisecond
+	maxMS, err := envInt64("ARCPOINT_POST_RETRY_MAX_MS", defaultPostRetryMax.Milliseconds())
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PostRetryMax = time.Duration(maxMS) * time.Millisecond
+	if cfg.PostRetryBase > cfg.PostRetryMax {
+		return cfg, fmt.Errorf("ARCPOINT_POST_RETRY_BASE_MS must not exceed ARCPOINT_POST_RETRY_MAX_MS")
+	}
+	if cfg.PostRetryMultiplier, err = envFloat("ARCPOINT_POST_RETRY_MULTIPLIER", defaultPostRetryMultiplier); err != nil {
+		return cfg, err
+	}
+	if cfg.PostRetryMultiplier < 1 {
+		return cfg, fmt.Errorf("ARCPOINT_POST_RETRY_MULTIPLIER must be at least 1 (got %g)", cfg.PostRetryMultiplier)
+	}
+	if cfg.RetryableStatus, err = envStatusSet("ARCPOINT_RETRYABLE_STATUS"); err != nil {
+		return cfg, err
+	}
+	if cfg.Tracing, err = envBool("ARCPOINT_TRACING"); err != nil {
+		return cfg, err
+	}
+	if cfg.RewriteIDs, err = envBool("ARCPOINT_REWRITE_IDS"); err != nil {
+		return cfg, err
+	}
+	if cfg.SendClientEnv, err = envBool("ARCPOINT_SEND_CLIENT_ENV"); err != nil {
+		return cfg, err
+	}
+	if cfg.ResponseTimeout, err = envDuration("ARCPOINT_RESPONSE_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.InitializeTimeout, err = envDuration("ARCPOINT_INITIALIZE_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.HonorRequestTimeout, err = envBool("ARCPOINT_HONOR_REQUEST_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.LateResponseWindow, err = envDuration("ARCPOINT_LATE_RESPONSE_WINDOW"); err != nil {
+		return cfg, err
+	}
+	if cfg.LateResponseWindow == 0 {
+		cfg.LateResponseWindow = defaultLateResponseWindow
+	}
+	if cfg.AnnotateTiming, err = envBool("ARCPOINT_ANNOTATE_TIMING"); err != nil {
+		return cfg, err
+	}
+	if cfg.SurfaceTrace, err = envBool("ARCPOINT_SURFACE_TRACE"); err != nil {
+		return cfg, err
+	}
+	if cfg.QueueSize, err = envNonNegInt("ARCPOINT_QUEUE_SIZE", 0); err != nil {
+		return cfg, err
+	}
+	cfg.QueueOverflow = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_QUEUE_OVERFLOW")))
+	switch cfg.QueueOverflow {
+	case "":
+		cfg.QueueOverflow = queueOverflowError
+	case queueOverflowError, queueOverflowDropOldest, queueOverflowDropNewest:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_QUEUE_OVERFLOW %q (expected error, drop-oldest or drop-newest)", cfg.QueueOverflow)
+	}
+	if cfg.FlushInterval, err = envDuration("ARCPOINT_FLUSH_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	cfg.OnDuplicateResponse = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_ON_DUPLICATE_RESPONSE")))
+	switch cfg.OnDuplicateResponse {
+	case "":
+		cfg.OnDuplicateResponse = duplicateForward
+	case duplicateForward, duplicateDrop:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_ON_DUPLICATE_RESPONSE %q (expected forward or drop)", cfg.OnDuplicateResponse)
+	}
+	if cfg.DedupResponses, err = envBool("ARCPOINT_DEDUP_RESPONSES"); err != nil {
+		return cfg, err
+	}
+	if cfg.DedupWindow, err = envDuration("ARCPOINT_DEDUP_WINDOW"); err != nil {
+		return cfg, err
+	}
+	if cfg.DedupWindow == 0 {
+		cfg.DedupWindow = defaultDedupWindow
+	}
+	cfg.DedupKey = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_DEDUP_KEY")))
+	switch cfg.DedupKey {
+	case "":
+		cfg.DedupKey = dedupKeyContent
+	case dedupKeyContent, dedupKeyEventID:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_DEDUP_KEY %q (expected content or event-id)", cfg.DedupKey)
+	}
+	if cfg.CoalesceProgress, err = envBool("ARCPOINT_COALESCE_PROGRESS"); err != nil {
+		return cfg, err
+	}
+	if cfg.ProgressInterval, err = envDuration("ARCPOINT_COALESCE_PROGRESS_INTERVAL"); err != nil {
+		return cfg, err
+	}
+	if cfg.ProgressInterval == 0 {
+		cfg.ProgressInterval = defaultProgressInterval
+	}
+	if cfg.MaxResponseBytes, err = envInt64("ARCPOINT_MAX_RESPONSE_BYTES", defaultMaxResponseBytes); err != nil {
+		return cfg, err
+	}
+
+	if cfg.MaxEventBytes, err = envInt64("ARCPOINT_MAX_EVENT_BYTES", defaultMaxResponseBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.RawSSE, err = envBool("ARCPOINT_RAW_SSE"); err != nil {
+		return cfg, err
+	}
+
+	if cfg.ChunkedResults, err = envBool("ARCPOINT_CHUNKED_RESULTS"); err != nil {
+		return cfg, err
+	}
+	if cfg.ReassembleFragments, err = envBool("ARCPOINT_REASSEMBLE_FRAGMENTS"); err != nil {
+		return cfg, err
+	}
+	cfg.StatusFile = strings.TrimSpace(os.Getenv("ARCPOINT_STATUS_FILE"))
+	if cfg.EventLogSize, err = envInt("ARCPOINT_EVENT_LOG_SIZE", defaultEventLogSize); err != nil {
+		return cfg, err
+	}
+	if cfg.OfflineInit, err = envBool("ARCPOINT_OFFLINE_INIT"); err != nil {
+		return cfg, err
+	}
+	cfg.ProtocolVersion = strings.TrimSpace(os.Getenv("ARCPOINT_PROTOCOL_VERSION"))
+	if cfg.ProtocolVersion == "" {
+		cfg.ProtocolVersion = defaultProtocolVersion
+	}
+	if cfg.StrictOutput, err = envBool("ARCPOINT_STRICT_OUTPUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.ResponsesOnly, err = envBool("ARCPOINT_RESPONSES_ONLY"); err != nil {
+		return cfg, err
+	}
+	cfg.RecordPath = strings.TrimSpace(os.Getenv("ARCPOINT_RECORD"))
+	cfg.ReplayPath = strings.TrimSpace(os.Getenv("ARCPOINT_REPLAY"))
+	if cfg.RecordPath != "" && cfg.ReplayPath != "" {
+		return cfg, fmt.Errorf("ARCPOINT_RECORD and ARCPOINT_REPLAY can't be used together")
+	}
+	cfg.SSEDataTrim = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_SSE_DATA_TRIM")))
+	switch cfg.SSEDataTrim {
+	case "":
+		cfg.SSEDataTrim = sseDataTrimSpec
+	case sseDataTrimSpec, sseDataTrimAll, sseDataTrimNone:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_SSE_DATA_TRIM %q (expected spec, all or none)", cfg.SSEDataTrim)
+	}
+	switch eol := strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_OUTPUT_EOL"))); eol {
+	case "", "lf":
+		cfg.OutputEOL = "\n"
+	case "crlf":
+		cfg.OutputEOL = "\r\n"
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_OUTPUT_EOL %q (expected lf or crlf)", eol)
+	}
+	if cfg.SanitizeOutput, err = envBool("ARCPOINT_SANITIZE_OUTPUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownGrace, err = envDuration("ARCPOINT_SHUTDOWN_GRACE"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownGrace == 0 {
+		cfg.ShutdownGrace = defaultShutdownGrace
+	}
+	if cfg.ShutdownHardTimeout, err = envDuration("ARCPOINT_SHUTDOWN_HARD_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownHardTimeout == 0 {
+		cfg.ShutdownHardTimeout = defaultShutdownHardTimeout
+	}
+	cfg.APITokens = envList("ARCPOINT_API_TOKENS")
+	if len(cfg.APITokens) > 0 && os.Getenv("ARCPOINT_API_TOKEN") != "" {
+		return cfg, fmt.Errorf("set only one of ARCPOINT_API_TOKEN and ARCPOINT_API_TOKENS")
+	}
+	cfg.TokenPolicy = strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_TOKEN_POLICY")))
+	switch cfg.TokenPolicy {
+	case "":
+		cfg.TokenPolicy = tokenPolicyRoundRobin
+	case tokenPolicyRoundRobin, tokenPolicyFailover:
+	default:
+		return cfg, fmt.Errorf("unknown ARCPOINT_TOKEN_POLICY %q (expected round-robin or failover)", cfg.TokenPolicy)
+	}
+	if cfg.ByteFidelity, err = envBool("ARCPOINT_BYTE_FIDELITY"); err != nil {
+		return cfg, err
+	}
+	if cfg.ByteFidelity {
+		// Server requests from several streams are forwarded under ids the
+		// client makes up, so there is no exact form to keep
+		if len(cfg.Streams) > 1 {
+			return cfg, fmt.Errorf("ARCPOINT_BYTE_FIDELITY can't be used with several ARCPOINT_STREAMS, which rewrites server request ids")
+		}
+		cfg.applyByteFidelity()
+	}
+
+	return cfg, nil
+}
+
+// applyByteFidelity turns off every setting that would change or drop a
+// server payload on its way to the host, recording the ones that were on
+func (cfg *Config) applyByteFidelity() {
+	off := func(name string, enabled *bool) {
+		if *enabled {
+			cfg.FidelityBypassed = append(cfg.FidelityBypassed, name)
+			*enabled = false
+		}
+	}
+	off("ARCPOINT_REWRITE_IDS", &cfg.RewriteIDs)
+	off("ARCPOINT_ANNOTATE_TIMING", &cfg.AnnotateTiming)
+	off("ARCPOINT_SURFACE_TRACE", &cfg.SurfaceTrace)
+	off("ARCPOINT_COALESCE_PROGRESS", &cfg.CoalesceProgress)
+	off("ARCPOINT_CHUNKED_RESULTS", &cfg.ChunkedResults)
+	off("ARCPOINT_REASSEMBLE_FRAGMENTS", &cfg.ReassembleFragments)
+	off("ARCPOINT_SANITIZE_OUTPUT", &cfg.SanitizeOutput)
+	off("ARCPOINT_DEDUP_RESPONSES", &cfg.DedupResponses)
+	off("ARCPOINT_RESPONSES_ONLY", &cfg.ResponsesOnly)
+	off("ARCPOINT_STRICT_OUTPUT", &cfg.StrictOutput)
+	if cfg.OnDuplicateResponse == duplicateDrop {
+		cfg.FidelityBypassed = append(cfg.FidelityBypassed, "ARCPOINT_ON_DUPLICATE_RESPONSE")
+		cfg.OnDuplicateResponse = duplicateForward
+	}
+	if cfg.SSEDataTrim != sseDataTrimSpec {
+		cfg.FidelityBypassed = append(cfg.FidelityBypassed, "ARCPOINT_SSE_DATA_TRIM")
+		cfg.SSEDataTrim = sseDataTrimSpec
+	}
+}
+
+// envDuration parses a duration such as "30s" from the named variable
+func envDuration(name string) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as \"30s\" (got %q)", name, value)
+	}
+	return d, nil
+}
+
+// envBool parses a boolean such as "true" or "1" from the named variable
+func envBool(name string) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false (got %q)", name, value)
+	}
+	return b, nil
+}
+
+// envInt64 parses a positive integer from the named variable, returning def
+// when it is unset
+func envInt64(name string, def int64) (int64, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer (got %q)", name, value)
+	}
+	return n, nil
+}
+
+// envFloat parses a positive number from the named variable, returning def
+// when it is unset
+func envFloat(name string, def float64) (float64, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s must be a positive number (got %q)", name, value)
+	}
+	return f, nil
+}
+
+// envInt parses a positive integer from the named variable, returning def
+// when it is unset
+func envInt(name string, def int) (int, error) {
+	n, err := envInt64(name, int64(def))
+	return int(n), err
+}
+
+// envNonNegInt parses a zero or positive integer from the named variable,
+// returning def when it is unset, for counts where 0 has a meaning of its
+// own
+func envNonNegInt(name string, def int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be zero or a positive integer (got %q)", name, value)
+	}
+	return n, nil
+}
+
+// envLocalAddr parses a local IP address from the named variable and checks
+// that outgoing connections can actually be bound to it
+func envLocalAddr(name string) (*net.TCPAddr, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("%s must be an IP address (got %q)", name, value)
+	}
+	addr := &net.TCPAddr{IP: ip}
+
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot bind to %s: %w", name, value, err)
+	}
+	ln.Close()
+	return addr, nil
+}
+
+// envURL parses an http or https base URL from the named variable,
+// without a trailing slash
+func envURL(name string) (string, error) {
+	value := strings.TrimSuffix(strings.TrimSpace(os.Getenv(name)), "/")
+	if value == "" {
+		return "", nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%s must be an http or https URL (got %q)", name, value)
+	}
+	return value, nil
+}
+
+// envProxy parses ARCPOINT_PROXY, adding credentials from
+// ARCPOINT_PROXY_USER and ARCPOINT_PROXY_PASS so they needn't appear in the
+// URL, where process listings would show them
+func envProxy() (*url.URL, error) {
+	value := strings.TrimSpace(os.Getenv("ARCPOINT_PROXY"))
+	user := os.Getenv("ARCPOINT_PROXY_USER")
+	pass := os.Getenv("ARCPOINT_PROXY_PASS")
+	if value == "" {
+		if user != "" || pass != "" {
+			return nil, fmt.Errorf("ARCPOINT_PROXY_USER and ARCPOINT_PROXY_PASS require ARCPOINT_PROXY")
+		}
+		return nil, nil
+	}
+
+	proxy, err := url.Parse(value)
+	if err != nil || proxy.Host == "" {
+		return nil, fmt.Errorf("invalid ARCPOINT_PROXY (expected a URL such as http://proxy.example.com:8080)")
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported ARCPOINT_PROXY scheme %q (expected http, https or socks5)", proxy.Scheme)
+	}
+	if user != "" {
+		proxy.User = url.UserPassword(user, pass)
+	} else if pass != "" {
+		return nil, fmt.Errorf("ARCPOINT_PROXY_PASS requires ARCPOINT_PROXY_USER")
+	}
+	return proxy, nil
+}
+
+// envMethodHeaders parses a JSON object mapping JSON-RPC methods to extra
+// request headers, e.g. {"tools/call": {"X-Cache": "bypass"}}
+func envMethodHeaders(name string) (map[string]map[string]string, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil, nil
+	}
+	var headers map[string]map[string]string
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object of method to headers: %w", name, err)
+	}
+	for method, set := range headers {
+		for header, v := range set {
+			if !validHeaderName(header) || !validHeaderValue(v) {
+				return nil, fmt.Errorf("%s: invalid header %q for method %q", name, header, method)
+			}
+		}
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether s is a legal HTTP header field name
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether s can be sent as a header value without
+// allowing header injection
+func validHeaderValue(s string) bool {
+	for _, r := range s {
+		if r == '\r' || r == '\n' || r == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// envPaths parses a comma-separated list of distinct URL paths, adding a
+// leading slash where it is missing
+func envPaths(name string) ([]string, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil, nil
+	}
+	var paths []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(value, ",") {
+		path := strings.TrimSpace(field)
+		if path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("%s lists %q more than once", name, path)
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// envSet parses a comma-separated list of names, returning nil when the
+// variable is unset or empty
+func envSet(name string) map[string]bool {
+	var set map[string]bool
+	for _, field := range strings.Split(os.Getenv(name), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[field] = true
+		}
+	}
+	return set
+}
+
+// envList parses a comma-separated list, skipping empty entries
+func envList(name string) []string {
+	var list []string
+	for _, field := range strings.Split(os.Getenv(name), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
+}
+
+// envStatusSet parses a comma-separated list of HTTP status codes
+func envStatusSet(name string) (map[int]bool, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil, nil
+	}
+	set := make(map[int]bool)
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%s must be a comma-separated list of HTTP status codes (got %q)", name, field)
+		}
+		set[code] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestByteFidelityTurnsOffDroppingSettings(t *testing.T) {
+	for key, value := range map[string]string{
+		"ARCPOINT_BYTE_FIDELITY":         "true",
+		"ARCPOINT_DEDUP_RESPONSES":       "true",
+		"ARCPOINT_RESPONSES_ONLY":        "true",
+		"ARCPOINT_STRICT_OUTPUT":         "true",
+		"ARCPOINT_ON_DUPLICATE_RESPONSE": "drop",
+	} {
+		t.Setenv(key, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DedupResponses || cfg.ResponsesOnly || cfg.StrictOutput || cfg.OnDuplicateResponse != duplicateForward {
+		t.Errorf("settings that drop payloads are still on: %+v", cfg)
+	}
+	for _, name := range []string{"ARCPOINT_DEDUP_RESPONSES", "ARCPOINT_RESPONSES_ONLY", "ARCPOINT_STRICT_OUTPUT", "ARCPOINT_ON_DUPLICATE_RESPONSE"} {
+		if !slices.Contains(cfg.FidelityBypassed, name) {
+			t.Errorf("%s missing from the bypassed settings %v", name, cfg.FidelityBypassed)
+		}
+	}
+}
+
+func TestZeroCountsAreAccepted(t *testing.T) {
+	for name, field := range map[string]func(Config) int{
+		"ARCPOINT_INITIAL_CONNECT_RETRIES": func(cfg Config) int { return cfg.InitialConnectRetries },
+		"ARCPOINT_POST_RETRIES":            func(cfg Config) int { return cfg.PostRetries },
+		"ARCPOINT_MAX_RECONNECTS":          func(cfg Config) int { return cfg.MaxReconnects },
+		"ARCPOINT_QUEUE_SIZE":              func(cfg Config) int { return cfg.QueueSize },
+	} {
+		t.Setenv(name, "0")
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Errorf("%s=0: %v", name, err)
+			continue
+		}
+		if got := field(cfg); got != 0 {
+			t.Errorf("%s=0 gave %d", name, got)
+		}
+		t.Setenv(name, "-1")
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("%s=-1 was accepted", name)
+		}
+		t.Setenv(name, "")
+	}
+}
+
+func TestByteFidelityRejectsSeveralStreams(t *testing.T) {
+	t.Setenv("ARCPOINT_BYTE_FIDELITY", "true")
+	t.Setenv("ARCPOINT_STREAMS", "/sse,/sse/tools")
+	if _, err := loadConfig(); err == nil {
+		t.Error("several streams, which rewrite server request ids, were accepted with byte fidelity")
+	}
+}
+
+func TestByteFidelityKeepsLineTerminators(t *testing.T) {
+	for _, tt := range []struct {
+		fidelity string
+		want     string
+	}{
+		{"false", "{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\n"},
+		{"true", "{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\r\n"},
+	} {
+		c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_BYTE_FIDELITY": tt.fidelity})
+		c.out.WriteLine([]byte("{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\r\n"))
+		if got := flushOutput(t, c, out); got != tt.want {
+			t.Errorf("fidelity=%s: got %q, want %q", tt.fidelity, got, tt.want)
+		}
+	}
+}
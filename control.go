@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Process exit statuses
+const (
+	// exitServerShutdown is used when the server tells the client to stop
+	exitServerShutdown = 3
+)
+
+// exitError stops the client and asks main to exit with a specific status
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCode maps the error Run returned to the process exit status. A nil
+// error or one caused by cancellation is a clean shutdown and exits 0.
+func exitCode(err error) int {
+	var exitErr *exitError
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	default:
+		return 1
+	}
+}
+
+// controlMessage is the payload of an `event: control` SSE event, which the
+// server uses to manage the client itself rather than talk to the host
+type controlMessage struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// handleControl acts on a control event. A shutdown action returns an
+// exitError that ends the client instead of reconnecting.
+func (c *SSEClient) handleControl(eventData []string) error {
+	var ctrl controlMessage
+	if err := json.Unmarshal([]byte(strings.Join(eventData, "\n")), &ctrl); err != nil {
+		log.Printf("Ignoring malformed control event: %v", err)
+		return nil
+	}
+
+	switch ctrl.Action {
+	case "shutdown":
+		reason := ctrl.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		log.Printf("Server requested shutdown: %s", reason)
+		return &exitError{code: exitServerShutdown, err: fmt.Errorf("server requested shutdown: %s", reason)}
+	case "":
+		// Carries only information, such as the server version
+		return nil
+	default:
+		log.Printf("Ignoring unknown control action %q", ctrl.Action)
+		return nil
+	}
+}
+
+// stopWith ends Run with err. Only the first call has any effect.
+func (c *SSEClient) stopWith(err error) {
+	select {
+	case c.stop <- err:
+	default:
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, 0},
+		{"cancelled", context.Canceled, 0},
+		{"wrapped cancellation", fmt.Errorf("stopping: %w", context.Canceled), 0},
+		{"server shutdown", &exitError{code: exitServerShutdown, err: errors.New("shutdown")}, exitServerShutdown},
+		{"wrapped exit error", fmt.Errorf("stream: %w", &exitError{code: 7, err: errors.New("stop")}), 7},
+		{"other error", errors.New("connection refused"), 1},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
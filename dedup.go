@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Ways ARCPOINT_DEDUP_KEY can identify a duplicate SSE message
+const (
+	// dedupKeyContent matches messages with identical data
+	dedupKeyContent = "content"
+	// dedupKeyEventID matches messages with the same SSE event id, falling
+	// back to content for events without one
+	dedupKeyEventID = "event-id"
+)
+
+// defaultDedupWindow is how long forwarded messages are remembered
+const defaultDedupWindow = 30 * time.Second
+
+// dedupWindow remembers recently forwarded messages so one delivered twice
+// within the window, e.g. on both streams during failover, is dropped
+type dedupWindow struct {
+	mu        sync.Mutex
+	window    time.Duration
+	clock     clock
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// newDedupWindow creates an empty dedup window
+func newDedupWindow(window time.Duration, clk clock) *dedupWindow {
+	return &dedupWindow{window: window, clock: clk, seen: make(map[string]time.Time)}
+}
+
+// seenBefore records key and reports whether it was already recorded
+// within the window
+func (d *dedupWindow) seenBefore(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	if now.Sub(d.lastPrune) > d.window {
+		for k, at := range d.seen {
+			if now.Sub(at) > d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// dedupKey identifies an SSE message on stream s for deduplication. Keys
+// include the stream path since each stream numbers its events, and its
+// session its requests, independently.
+func (c *SSEClient) dedupKey(s *sseStream, eventID string, data []byte) string {
+	if c.cfg.DedupKey == dedupKeyEventID && eventID != "" {
+		return s.path + " id:" + eventID
+	}
+	sum := sha256.Sum256(data)
+	return s.path + " " + hex.EncodeToString(sum[:])
+}
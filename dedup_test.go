@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupOnlyDropsRepeatedResponsesOnOneStream(t *testing.T) {
+	captureLog(t)
+	c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{
+		"ARCPOINT_DEDUP_RESPONSES": "true",
+		"ARCPOINT_STREAMS":         "/a,/b",
+	})
+	a, b := c.streams[0], c.streams[1]
+	notification := `{"jsonrpc":"2.0","method":"notifications/tools/list_changed"}`
+	response := `{"jsonrpc":"2.0","id":1,"result":{}}`
+	for _, event := range []struct {
+		stream *sseStream
+		data   string
+	}{
+		{a, notification}, {a, notification},
+		{a, response}, {a, response},
+		{b, response},
+	} {
+		c.handleEvent(event.stream, "message", "", []string{event.data})
+	}
+
+	got := flushOutput(t, c, out)
+	if n := strings.Count(got, "list_changed"); n != 2 {
+		t.Errorf("forwarded %d of 2 identical notifications", n)
+	}
+	if n := strings.Count(got, `"id":1`); n != 2 {
+		t.Errorf("forwarded %d responses, want one per stream", n)
+	}
+}
+
+func TestDedupWindowExpires(t *testing.T) {
+	clk := newFakeClock()
+	d := newDedupWindow(30*time.Second, clk)
+	if d.seenBefore("k") {
+		t.Fatal("first sighting reported as a duplicate")
+	}
+	clk.Advance(29 * time.Second)
+	if !d.seenBefore("k") {
+		t.Fatal("repeat within the window was not a duplicate")
+	}
+	clk.Advance(31 * time.Second)
+	if d.seenBefore("k") {
+		t.Fatal("repeat after the window was still a duplicate")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// resolveEndpoint turns the endpoint a server advertises into the URL that
+// messages are posted to. A rooted path is placed under baseURL's path
+// prefix, since gateways usually strip the prefix before the server sees
+// the request, unless it already includes it. A relative path is resolved
+// against the stream's URL. Absolute URLs must stay on baseURL's host so
+// the token is never sent elsewhere.
+func resolveEndpoint(baseURL, streamPath, endpoint string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(strings.TrimSpace(endpoint))
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+
+	switch {
+	case ref.IsAbs() || ref.Host != "":
+		resolved := base.ResolveReference(ref)
+		if resolved.Scheme != base.Scheme || resolved.Host != base.Host {
+			return "", fmt.Errorf("endpoint %q is not on %s", endpoint, base.Host)
+		}
+		return resolved.String(), nil
+	case strings.HasPrefix(ref.Path, "/"):
+		prefix := strings.TrimSuffix(base.Path, "/")
+		if prefix != "" && ref.Path != prefix && !strings.HasPrefix(ref.Path, prefix+"/") {
+			ref.Path = prefix + ref.Path
+		}
+		return base.ResolveReference(ref).String(), nil
+	default:
+		stream, err := url.Parse(baseURL + streamPath)
+		if err != nil {
+			return "", err
+		}
+		return stream.ResolveReference(ref).String(), nil
+	}
+}
+
+// withoutSessionQuery removes the sessionId query parameter from a message
+// URL, for servers that take the session in a header instead
+func withoutSessionQuery(messageURL string) string {
+	u, err := url.Parse(messageURL)
+	if err != nil {
+		return messageURL
+	}
+	query := u.Query()
+	query.Del("sessionId")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestResolveEndpointWithPathPrefix(t *testing.T) {
+	tests := []struct {
+		base, endpoint, want string
+	}{
+		{"https://gw.example.com", "/message?sessionId=s1", "https://gw.example.com/message?sessionId=s1"},
+		{"https://gw.example.com/arcpoint", "/message?sessionId=s1", "https://gw.example.com/arcpoint/message?sessionId=s1"},
+		{"https://gw.example.com/arcpoint/", "/message?sessionId=s1", "https://gw.example.com/arcpoint/message?sessionId=s1"},
+		{"https://gw.example.com/arcpoint", "/arcpoint/message?sessionId=s1", "https://gw.example.com/arcpoint/message?sessionId=s1"},
+		{"https://gw.example.com/arcpoint", "/arcpointer/message", "https://gw.example.com/arcpoint/arcpointer/message"},
+		{"https://gw.example.com/arcpoint", "message?sessionId=s1", "https://gw.example.com/arcpoint/message?sessionId=s1"},
+		{"https://gw.example.com/arcpoint", "https://gw.example.com/other/message", "https://gw.example.com/other/message"},
+	}
+	for _, tt := range tests {
+		got, err := resolveEndpoint(tt.base, "/sse", tt.endpoint)
+		if err != nil {
+			t.Errorf("%s + %s: %v", tt.base, tt.endpoint, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s + %s = %s, want %s", tt.base, tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestResolveEndpointRefusesOtherHosts(t *testing.T) {
+	for _, endpoint := range []string{"https://evil.example.com/message", "//evil.example.com/message", "http://gw.example.com/message"} {
+		if got, err := resolveEndpoint("https://gw.example.com/arcpoint", "/sse", endpoint); err == nil {
+			t.Errorf("%s resolved to %s, want an error", endpoint, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// defaultEnvFile is read from the working directory when ARCPOINT_ENV_FILE
+// is not set, if it exists
+const defaultEnvFile = ".env"
+
+// defaultEnvFileAllowed are the settings the default file may supply. It
+// is picked up from whatever directory the client starts in, so it is
+// limited to settings that only tune timing, limits and logging, and can't
+// run commands, read or write files, or send the token somewhere else.
+var defaultEnvFileAllowed = map[string]bool{
+	"ARCPOINT_API_TOKEN":                   true,
+	"ARCPOINT_API_TOKENS":                  true,
+	"ARCPOINT_TOKEN_POLICY":                true,
+	"ARCPOINT_CONNECTION_NAME":             true,
+	"ARCPOINT_INSTANCE_LABEL":              true,
+	"ARCPOINT_LOG_LEVEL":                   true,
+	"ARCPOINT_QUIET":                       true,
+	"ARCPOINT_RECONNECT_LOG_INTERVAL":      true,
+	"ARCPOINT_IDLE_TIMEOUT":                true,
+	"ARCPOINT_ENDPOINT_TIMEOUT":            true,
+	"ARCPOINT_ENDPOINT_COLD_START_TIMEOUT": true,
+	"ARCPOINT_INITIALIZE_TIMEOUT":          true,
+	"ARCPOINT_RESPONSE_TIMEOUT":            true,
+	"ARCPOINT_HONOR_REQUEST_TIMEOUT":       true,
+	"ARCPOINT_LATE_RESPONSE_WINDOW":        true,
+	"ARCPOINT_INITIAL_CONNECT_RETRIES":     true,
+	"ARCPOINT_MAX_RECONNECTS":              true,
+	"ARCPOINT_RECONNECT_WINDOW":            true,
+	"ARCPOINT_SHORT_CONNECTION_DELAY":      true,
+	"ARCPOINT_MAX_CONNECTION_AGE":          true,
+	"ARCPOINT_POST_RETRIES":                true,
+	"ARCPOINT_POST_RETRY_BASE_MS":          true,
+	"ARCPOINT_POST_RETRY_MAX_MS":           true,
+	"ARCPOINT_POST_RETRY_MULTIPLIER":       true,
+	"ARCPOINT_RETRYABLE_STATUS":            true,
+	"ARCPOINT_QUEUE_SIZE":                  true,
+	"ARCPOINT_QUEUE_OVERFLOW":              true,
+	"ARCPOINT_FLUSH_INTERVAL":              true,
+	"ARCPOINT_KEEPALIVE_POST_INTERVAL":     true,
+	"ARCPOINT_HOST_KEEPALIVE_INTERVAL":     true,
+	"ARCPOINT_ECHO_STDIN_KEEPALIVE":        true,
+	"ARCPOINT_IDLE_STDIN_TIMEOUT":          true,
+	"ARCPOINT_ALLOW_NO_STDIN":              true,
+	"ARCPOINT_SKIP_EOF_WAIT":               true,
+	"ARCPOINT_SHUTDOWN_GRACE":              true,
+	"ARCPOINT_SHUTDOWN_HARD_TIMEOUT":       true,
+	"ARCPOINT_MAX_LIFETIME":                true,
+	"ARCPOINT_MAX_LIFETIME_WARNING":        true,
+	"ARCPOINT_MAX_RESPONSE_BYTES":          true,
+	"ARCPOINT_MAX_EVENT_BYTES":             true,
+	"ARCPOINT_OUTPUT_EOL":                  true,
+}
+
+// loadEnvFile sets environment variables from simple KEY=VALUE lines in a
+// .env file. Variables already in the environment win, and blank lines and
+// # comments are ignored. A missing default file is not an error; a missing
+// file named by ARCPOINT_ENV_FILE is. The default file only supplies the
+// settings in defaultEnvFileAllowed.
+func loadEnvFile() error {
+	path := strings.TrimSpace(os.Getenv("ARCPOINT_ENV_FILE"))
+	explicit := path != ""
+	if !explicit {
+		path = defaultEnvFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if !explicit {
+			return fmt.Errorf("default env file: %w", err)
+		}
+		return fmt.Errorf("ARCPOINT_ENV_FILE: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+		value = unquoteEnvValue(strings.TrimSpace(value))
+		if !explicit && !defaultEnvFileAllowed[key] {
+			log.Printf("Ignoring %s from %s: only ARCPOINT_ENV_FILE may set it", key, path)
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// unquoteEnvValue strips one pair of matching single or double quotes
+func unquoteEnvValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeEnvFile writes a .env file into a fresh working directory
+func writeEnvFile(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, defaultEnvFile)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return path
+}
+
+// unsetEnv clears names for the rest of the test
+func unsetEnv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestDefaultEnvFileOnlySetsSafeSettings(t *testing.T) {
+	writeEnvFile(t, strings.Join([]string{
+		"ARCPOINT_LOG_LEVEL=debug",
+		"ARCPOINT_API_URL=https://attacker.example",
+		"ARCPOINT_ENV=local",
+		"ARCPOINT_API_TOKEN_COMMAND=touch pwned",
+		"HTTPS_PROXY=http://attacker.example:8080",
+	}, "\n"))
+	unsetEnv(t, "ARCPOINT_ENV_FILE", "ARCPOINT_LOG_LEVEL", "ARCPOINT_API_URL", "ARCPOINT_ENV", "ARCPOINT_API_TOKEN_COMMAND", "HTTPS_PROXY")
+	captureLog(t)
+
+	if err := loadEnvFile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("ARCPOINT_LOG_LEVEL"); got != "debug" {
+		t.Errorf("ARCPOINT_LOG_LEVEL = %q, want debug", got)
+	}
+	for _, name := range []string{"ARCPOINT_API_URL", "ARCPOINT_ENV", "ARCPOINT_API_TOKEN_COMMAND", "HTTPS_PROXY"} {
+		if value, set := os.LookupEnv(name); set {
+			t.Errorf("default .env set %s=%q", name, value)
+		}
+	}
+}
+
+func TestExplicitEnvFileSetsEverything(t *testing.T) {
+	path := writeEnvFile(t, "ARCPOINT_API_URL=https://staging.example\n")
+	unsetEnv(t, "ARCPOINT_API_URL")
+	t.Setenv("ARCPOINT_ENV_FILE", path)
+
+	if err := loadEnvFile(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("ARCPOINT_API_URL"); got != "https://staging.example" {
+		t.Errorf("ARCPOINT_API_URL = %q, want the value from ARCPOINT_ENV_FILE", got)
+	}
+}
+
+func TestDefaultEnvFileErrorNamesTheFile(t *testing.T) {
+	path := writeEnvFile(t, "")
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Open(path); err == nil {
+		f.Close()
+		t.Skip("file permissions are not enforced for this user")
+	}
+	unsetEnv(t, "ARCPOINT_ENV_FILE")
+
+	err := loadEnvFile()
+	if err == nil || strings.Contains(err.Error(), "ARCPOINT_ENV_FILE") {
+		t.Errorf("got error %v, want one that doesn't blame the unset ARCPOINT_ENV_FILE", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultEventLogSize is the default number of connection events retained
+const defaultEventLogSize = 50
+
+// connEvent is one connection state transition
+type connEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Stream string    `json:"stream,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// eventLog is a fixed-size ring buffer of the most recent connection
+// events, kept for post-mortem debugging
+type eventLog struct {
+	mu     sync.Mutex
+	events []connEvent
+	next   int
+	full   bool
+}
+
+// newEventLog creates a log holding at most size events
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]connEvent, size)}
+}
+
+// add appends an event, overwriting the oldest once the log is full
+func (l *eventLog) add(ev connEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return
+	}
+	l.events[l.next] = ev
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// snapshot returns the retained events, oldest first
+func (l *eventLog) snapshot() []connEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]connEvent(nil), l.events[:l.next]...)
+	}
+	out := make([]connEvent, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	return append(out, l.events[:l.next]...)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Defaults for failing over to ARCPOINT_API_URL_FALLBACK
+const (
+	defaultFailoverAfter    = 3
+	defaultFailbackInterval = 5 * time.Minute
+)
+
+// base returns the URL of the backend currently in use
+func (c *SSEClient) base() string {
+	if c.onFallback.Load() {
+		return c.cfg.FallbackURL
+	}
+	return c.baseURL
+}
+
+// backendSwitched returns a channel that is closed the next time the client
+// switches between the primary and fallback backends
+func (c *SSEClient) backendSwitched() <-chan struct{} {
+	c.switchMu.Lock()
+	defer c.switchMu.Unlock()
+	return c.switched
+}
+
+// switchBackend moves every stream to the fallback (or back to the
+// primary), dropping their sessions so they are re-established there.
+// It reports false if the client was already using that backend.
+func (c *SSEClient) switchBackend(fallback bool) bool {
+	c.switchMu.Lock()
+	defer c.switchMu.Unlock()
+	if c.onFallback.Load() == fallback {
+		return false
+	}
+	c.onFallback.Store(fallback)
+	for _, s := range c.streams {
+		s.setEndpoint("")
+		s.setSessionID("")
+	}
+	close(c.switched)
+	c.switched = make(chan struct{})
+	return true
+}
+
+// failover switches away from a backend that keeps failing: from the
+// primary to the fallback, or back again if the fallback is failing too.
+// Nothing happens if another stream already switched.
+func (c *SSEClient) failover(ctx context.Context, fromFallback bool, failed int) {
+	if !fromFallback {
+		if c.switchBackend(true) {
+			log.Printf("Failing over to %s after %d failed attempts against %s", c.cfg.FallbackURL, failed, c.baseURL)
+			c.recordEvent(connEvent{Kind: "failover", Reason: c.cfg.FallbackURL})
+			c.startWatchingPrimary(ctx)
+		}
+		return
+	}
+	if c.switchBackend(false) {
+		log.Printf("Fallback %s failed %d times too, switching back to %s", c.cfg.FallbackURL, failed, c.baseURL)
+		c.recordEvent(connEvent{Kind: "failback", Reason: c.baseURL})
+	}
+}
+
+// startWatchingPrimary starts watchPrimary unless it is already running, so
+// a flapping connection can't stack up watchers and probe sessions
+func (c *SSEClient) startWatchingPrimary(ctx context.Context) {
+	if !c.watching.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		for {
+			c.watchPrimary(ctx)
+			c.watching.Store(false)
+			// A failover while the watcher was finishing found it still
+			// running, so it carries on for that one
+			if ctx.Err() != nil || !c.onFallback.Load() || !c.watching.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+// watchPrimary periodically checks whether the primary backend is
+// reachable again while the client is on the fallback, and fails back once
+// it is
+func (c *SSEClient) watchPrimary(ctx context.Context) {
+	for c.onFallback.Load() {
+		c.sleep(ctx, c.cfg.FailbackInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		if err := c.probePrimary(ctx); err != nil {
+			debugf("Primary %s still unavailable: %v", c.baseURL, err)
+			continue
+		}
+		if c.switchBackend(false) {
+			log.Printf("Primary %s is reachable again, failing back from %s", c.baseURL, c.cfg.FallbackURL)
+			c.recordEvent(connEvent{Kind: "failback", Reason: c.baseURL})
+		}
+		return
+	}
+}
+
+// probePrimary opens the primary's first SSE stream to check that it
+// answers, closing it again straight away
+func (c *SSEClient) probePrimary(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+c.streams[0].path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.tokens.pick())
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK || !isEventStream(resp) {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	// Dropping the connection ends the probe's session on the server, as
+	// it does for any SSE client that goes away
+	cancel()
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRepeatedFailoversShareOnePrimaryWatcher(t *testing.T) {
+	captureLog(t)
+	clk := newFakeClock()
+	c, _ := newTestClientWithClock(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_API_URL_FALLBACK": "http://127.0.0.1:1"}, clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c.failover(ctx, false, 3)
+	<-clk.started
+	// Flap back to the primary and away again while the first watcher sleeps
+	c.failover(ctx, true, 3)
+	c.failover(ctx, false, 3)
+	select {
+	case d := <-clk.started:
+		t.Errorf("a second watcher started a %s timer", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// failureLogBurst is how many identical connection failures in a row are
+// logged in full before they are coalesced into summaries
+const failureLogBurst = 3
+
+// defaultFailureLogInterval is how often a summary of coalesced connection
+// failures is logged
+const defaultFailureLogInterval = time.Minute
+
+// failureLog coalesces repeated identical connection failures so a long
+// outage doesn't fill the disk with reconnect lines
+type failureLog struct {
+	interval time.Duration
+	clock    clock
+	key      string
+	count    int       // consecutive failures with key
+	since    time.Time // when the first of them happened
+	lastLog  time.Time
+}
+
+// newFailureLog creates a failure log that summarises every interval
+func newFailureLog(interval time.Duration, clk clock) *failureLog {
+	return &failureLog{interval: interval, clock: clk}
+}
+
+// failure records a failed attempt described by key and reports whether it
+// should be logged in full. Once the burst is used up, a summary is logged
+// instead every interval.
+func (f *failureLog) failure(label, key string) bool {
+	now := f.clock.Now()
+	if key != f.key {
+		f.key = key
+		f.count = 0
+		f.since = now
+	}
+	f.count++
+	if f.count <= failureLogBurst {
+		f.lastLog = now
+		return true
+	}
+	if now.Sub(f.lastLog) >= f.interval {
+		log.Printf("%sStill unable to connect, %d attempts over %s (last error: %s)",
+			label, f.count, now.Sub(f.since).Round(time.Second), key)
+		f.lastLog = now
+	}
+	return false
+}
+
+// coalescing reports whether failures are currently being summarised, in
+// which case routine per-attempt lines are skipped too
+func (f *failureLog) coalescing() bool {
+	return f.count >= failureLogBurst
+}
+
+// connected ends a run of failures, noting how long it lasted if any of it
+// was coalesced
+func (f *failureLog) connected(label string) {
+	if f.count > failureLogBurst {
+		log.Printf("%sConnected after %d failed attempts over %s", label, f.count, f.clock.Now().Sub(f.since).Round(time.Second))
+	}
+	f.key = ""
+	f.count = 0
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+// reassembleFragment buffers message events from servers that split one
+// JSON value across several events with no wrapper. It returns the whole
+// value once the accumulated data parses, or nil while more is needed.
+func (c *SSEClient) reassembleFragment(s *sseStream, data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A later fragment may be valid JSON on its own, such as a nested
+	// object, so it continues the buffered message as long as the two can
+	// still form one. Only data that can't ends the unfinished message.
+	if len(s.fragments) > 0 {
+		combined := append(s.fragments, data...)
+		if jsonPrefix(combined) {
+			return c.bufferFragment(s, combined)
+		}
+		log.Printf("%sDiscarding %d bytes of incomplete fragments", s.label, len(s.fragments))
+		s.fragments = nil
+	}
+	if completeJSON(data) {
+		return data
+	}
+	return c.bufferFragment(s, append([]byte(nil), data...))
+}
+
+// bufferFragment makes data the stream's buffered message, returning it
+// instead if it is already complete. s.mu must be held.
+func (c *SSEClient) bufferFragment(s *sseStream, data []byte) []byte {
+	if completeJSON(data) {
+		s.fragments = nil
+		return data
+	}
+	if int64(len(data)) > c.cfg.MaxEventBytes {
+		log.Printf("%sDropping fragmented message larger than %d bytes", s.label, c.cfg.MaxEventBytes)
+		s.fragments = nil
+		return nil
+	}
+	s.fragments = data
+	return nil
+}
+
+// jsonPrefix reports whether data is the start of a JSON object or array,
+// possibly already complete, that more data could finish
+func jsonPrefix(data []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return false
+	}
+	if tok != json.Delim('{') && tok != json.Delim('[') {
+		return false
+	}
+	for {
+		if _, err := dec.Token(); err != nil {
+			return err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// completeJSON reports whether data is a whole JSON object or array
+func completeJSON(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed)
+}
+
+// resetFragments discards any partly reassembled message, whose remaining
+// fragments were lost with the connection
+func (s *sseStream) resetFragments() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fragments = nil
+}
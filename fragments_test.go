@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReassembleFragments(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		want   []string
+	}{
+		{"whole message", []string{`{"id":1}`}, []string{`{"id":1}`}},
+		{"split message", []string{`{"id":1,`, `"result":{}}`}, []string{`{"id":1,"result":{}}`}},
+		{
+			"fragment that is valid JSON on its own",
+			[]string{`{"id":1,"result":`, `{"content":[]}`, `}`},
+			[]string{`{"id":1,"result":{"content":[]}}`},
+		},
+		{
+			"unfinished message ended by a new one",
+			[]string{`{"id":1,"result":`, `]`, `{"id":2}`},
+			[]string{`{"id":2}`},
+		},
+	}
+	for _, tt := range tests {
+		captureLog(t)
+		c, out := newTestClient(t, "http://127.0.0.1:0", nil)
+		var got []string
+		for _, event := range tt.events {
+			if message := c.reassembleFragment(c.streams[0], []byte(event)); message != nil {
+				got = append(got, string(message))
+			}
+		}
+		flushOutput(t, c, out)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
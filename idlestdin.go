@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// markSessionReady records that a session is available for the host's
+// messages. Only the first call has any effect.
+func (c *SSEClient) markSessionReady() {
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+// watchIdleStdin stops the client if the host sends nothing within
+// IdleStdinTimeout of the session becoming ready, so a misconfigured host
+// doesn't hold a session open forever
+func (c *SSEClient) watchIdleStdin(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-c.ready:
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-c.clock.After(c.cfg.IdleStdinTimeout):
+	}
+
+	if c.stdinMessages.Load() == 0 {
+		log.Printf("No message from the host within %s of the session being ready (ARCPOINT_IDLE_STDIN_TIMEOUT), shutting down", c.cfg.IdleStdinTimeout)
+		c.stopWith(nil)
+	}
+}
+
+// hostHeartbeat is written to stdout to show an idle host the client is
+// still alive
+var hostHeartbeat = []byte(`{"jsonrpc":"2.0","method":"notifications/arcpoint/heartbeat"}`)
+
+// stdinKeepaliveReply answers a blank stdin line. It is a different
+// notification from hostHeartbeat so a host can tell a reply to its own
+// keepalive from the client's idle heartbeat.
+var stdinKeepaliveReply = []byte(`{"jsonrpc":"2.0","method":"notifications/arcpoint/keepalive"}`)
+
+// hostKeepalive writes a heartbeat notification whenever stdout has been
+// quiet for HostKeepaliveInterval, for hosts that tear down idle servers.
+// Heartbeats start once a session is ready or the host has sent a message,
+// so a host still starting up isn't sent notifications it can't expect yet.
+func (c *SSEClient) hostKeepalive(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-c.ready:
+	case <-c.hostSpoke:
+	}
+
+	last := c.out.frames.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.clock.After(c.cfg.HostKeepaliveInterval):
+		}
+		if frames := c.out.frames.Load(); frames != last {
+			last = frames
+			continue
+		}
+		debugf("Sending heartbeat to the host after %s without output", c.cfg.HostKeepaliveInterval)
+		c.out.WriteLine(hostHeartbeat)
+		last = c.out.frames.Load()
+	}
+}
+
+// stdinClosed runs once the host's stdin reaches EOF and normally stops the
+// client. With AllowNoStdin, a stdin that was closed before any message
+// arrived, such as /dev/null, instead leaves the SSE stream running in
+// consume-only mode.
+func (c *SSEClient) stdinClosed(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	if c.cfg.AllowNoStdin && c.stdinMessages.Load() == 0 {
+		log.Println("stdin closed at startup, consuming the SSE stream only (ARCPOINT_ALLOW_NO_STDIN)")
+		return
+	}
+	if !c.cfg.SkipEOFWait {
+		c.awaitOutstanding(ctx)
+	}
+	log.Println("stdin closed, shutting down")
+	c.stopWith(nil)
+}
+
+// outstandingPoll is how often awaitOutstanding checks for answers
+const outstandingPoll = 50 * time.Millisecond
+
+// awaitOutstanding waits up to ShutdownGrace for the responses to requests
+// the host has already sent, which may still be on their way over SSE, and
+// for any message POSTs still in flight
+func (c *SSEClient) awaitOutstanding(ctx context.Context) {
+	deadline := c.clock.After(c.cfg.ShutdownGrace)
+	for c.pending.count() > 0 || c.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Printf("Gave up waiting for %d outstanding responses after %s", c.pending.count(), c.cfg.ShutdownGrace)
+			return
+		case <-c.clock.After(outstandingPoll):
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSSEServer serves /sse with an endpoint event and accepts each POST to
+// /message with 202, sending the result back as an SSE message after delay
+func newSSEServer(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	responses := make(chan string, 16)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: endpoint\ndata: /message?sessionId=s1\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case response := <-responses:
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", response)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+	mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+		msg := parseMessage(mustReadAll(t, r.Body))
+		w.WriteHeader(http.StatusAccepted)
+		if msg.isRequest() {
+			time.AfterFunc(delay, func() {
+				responses <- fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":{"method":%q}}`, msg.ID, msg.Method)
+			})
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func mustReadAll(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	return data
+}
+
+// runWithStdin runs c with stdin replaced by input, returning Run's error
+// once the client stops on its own
+func runWithStdin(t *testing.T, c *SSEClient, input string) error {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+	go func() {
+		io.WriteString(w, input)
+		w.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = c.Run(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("client did not stop after stdin closed")
+	}
+	return err
+}
+
+func TestStdinEOFForwardsFinalUnterminatedMessage(t *testing.T) {
+	for _, decode := range []string{"false", "true"} {
+		srv := newSSEServer(t, 100*time.Millisecond)
+		c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_STREAM_DECODE": decode})
+		c.streams[0].setSessionID("")
+
+		if err := runWithStdin(t, c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if got := flushOutput(t, c, out); !strings.Contains(got, `"id":1,"result"`) {
+			t.Errorf("stream decode %s: final message without a newline was not answered, got %q", decode, got)
+		}
+	}
+}
+
+func TestStdinEOFWaitsForSSEResponses(t *testing.T) {
+	srv := newSSEServer(t, 300*time.Millisecond)
+	c, out := newTestClient(t, srv.URL, nil)
+	c.streams[0].setSessionID("")
+
+	if err := runWithStdin(t, c, "{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"ping\"}\n{\"jsonrpc\":\"2.0\",\"id\":2,\"method\":\"tools/list\"}\n"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	got := flushOutput(t, c, out)
+	for _, id := range []string{`"id":1,"result"`, `"id":2,"result"`} {
+		if !strings.Contains(got, id) {
+			t.Errorf("response %s was lost at shutdown, got %q", id, got)
+		}
+	}
+}
+
+func TestStdinEOFWaitIsBounded(t *testing.T) {
+	srv := newSSEServer(t, time.Hour)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_SHUTDOWN_GRACE": "200ms"})
+	c.streams[0].setSessionID("")
+
+	started := time.Now()
+	if err := runWithStdin(t, c, "{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"ping\"}\n"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	flushOutput(t, c, out)
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %s with a 200ms grace period", elapsed)
+	}
+}
+
+func TestHostKeepaliveWaitsForSessionOrHost(t *testing.T) {
+	for _, start := range []string{"session", "host"} {
+		clk := newFakeClock()
+		c, out := newTestClientWithClock(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_HOST_KEEPALIVE_INTERVAL": "10s"}, clk)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.hostKeepalive(ctx)
+		}()
+
+		// Nothing is scheduled before the host or a session is ready
+		clk.Advance(time.Minute)
+		select {
+		case d := <-clk.started:
+			t.Fatalf("%s: heartbeat timer of %s started too early", start, d)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if start == "session" {
+			c.markSessionReady()
+		} else {
+			c.hostSpokeOnce.Do(func() { close(c.hostSpoke) })
+		}
+		clk.Advance(<-clk.started)
+		<-clk.started
+		cancel()
+		<-done
+		if got := flushOutput(t, c, out); got != string(hostHeartbeat)+"\n" {
+			t.Errorf("%s: got %q, want one heartbeat", start, got)
+		}
+	}
+}
+
+func TestBlankStdinLinesAreEchoedWhenEnabled(t *testing.T) {
+	for _, tt := range []struct {
+		echo string
+		want string
+	}{
+		{"false", ""},
+		{"true", strings.Repeat(string(stdinKeepaliveReply)+"\n", 2)},
+	} {
+		c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_ECHO_STDIN_KEEPALIVE": tt.echo})
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdin := os.Stdin
+		os.Stdin = r
+		io.WriteString(w, "\n\n")
+		w.Close()
+		c.readStdin(context.Background())
+		os.Stdin = stdin
+		r.Close()
+		if got := flushOutput(t, c, out); got != tt.want {
+			t.Errorf("echo=%s: got %q, want %q", tt.echo, got, tt.want)
+		}
+	}
+}
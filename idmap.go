@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// idMapper rewrites host request ids to unique internal ids on the way to
+// the server and restores them on responses, so requests the client makes
+// itself can never collide with ids the host chose
+type idMapper struct {
+	mu       sync.Mutex
+	next     uint64
+	toHost   map[string]json.RawMessage
+	toServer map[string]json.RawMessage
+}
+
+// internalIDPrefix starts every id outbound hands out
+const internalIDPrefix = `"arcpoint-`
+
+// newIDMapper creates an empty id mapper
+func newIDMapper() *idMapper {
+	return &idMapper{
+		toHost:   make(map[string]json.RawMessage),
+		toServer: make(map[string]json.RawMessage),
+	}
+}
+
+// outbound replaces the id of a host request with a fresh internal one
+func (m *idMapper) outbound(data []byte, hostID json.RawMessage) ([]byte, error) {
+	m.mu.Lock()
+	m.next++
+	internal := json.RawMessage(strconv.Quote("arcpoint-" + strconv.FormatUint(m.next, 10)))
+	m.toHost[string(internal)] = hostID
+	m.toServer[string(hostID)] = internal
+	m.mu.Unlock()
+
+	return replaceID(data, internal)
+}
+
+// inbound restores the host's id on a response to a rewritten request.
+// Messages with unknown ids are returned unchanged, with stale set if the
+// id is an internal one whose request was already answered or forgotten.
+func (m *idMapper) inbound(data []byte, id json.RawMessage) (restored []byte, stale bool, err error) {
+	m.mu.Lock()
+	hostID, ok := m.toHost[string(id)]
+	delete(m.toHost, string(id))
+	if ok && bytes.Equal(m.toServer[string(hostID)], id) {
+		delete(m.toServer, string(hostID))
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return data, bytes.HasPrefix(id, []byte(internalIDPrefix)), nil
+	}
+	restored, err = replaceID(data, hostID)
+	return restored, false, err
+}
+
+// serverID returns the internal id a host request was sent under
+func (m *idMapper) serverID(hostID json.RawMessage) (json.RawMessage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.toServer[string(hostID)]
+	return id, ok
+}
+
+// forget drops the mapping for a host request that has been answered
+// locally, e.g. with a timeout error, so a response the server sends
+// afterwards is recognised as stale
+func (m *idMapper) forget(hostID json.RawMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if internal, ok := m.toServer[string(hostID)]; ok {
+		delete(m.toServer, string(hostID))
+		delete(m.toHost, string(internal))
+	}
+}
+
+// replaceCancelledID returns a copy of a notifications/cancelled message
+// with params.requestId replaced, spliced in place like replaceID
+func replaceCancelledID(data []byte, id json.RawMessage) ([]byte, error) {
+	start, end, err := fieldSpan(data, "params")
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, errors.New("message has no params")
+	}
+	params, err := replaceField(data[start:end], "requestId", id)
+	if err != nil {
+		return nil, err
+	}
+	return replaceField(data, "params", params)
+}
+
+// replaceField returns a copy of a JSON object with an existing top-level
+// field's value replaced
+func replaceField(data []byte, name string, value json.RawMessage) ([]byte, error) {
+	start, end, err := fieldSpan(data, name)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, errors.New("object has no " + name)
+	}
+	out := make([]byte, 0, len(data)-(end-start)+len(value))
+	out = append(out, data[:start]...)
+	out = append(out, value...)
+	return append(out, data[end:]...), nil
+}
+
+// replaceID returns a copy of a JSON-RPC object with its id replaced. The
+// new id is spliced in place so the rest of the message, including large
+// content blocks, is forwarded byte for byte rather than re-encoded.
+func replaceID(data []byte, id json.RawMessage) ([]byte, error) {
+	start, end, err := fieldSpan(data, "id")
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		fields["id"] = id
+		return marshalVerbatim(fields)
+	}
+
+	out := make([]byte, 0, len(data)-(end-start)+len(id))
+	out = append(out, data[:start]...)
+	out = append(out, id...)
+	return append(out, data[end:]...), nil
+}
+
+// fieldSpan finds the byte range of a top-level field's value in a JSON
+// object, or returns -1 when the object has no such field
+func fieldSpan(data []byte, name string) (int, int, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return 0, 0, err
+	} else if tok != json.Delim('{') {
+		return 0, 0, errors.New("message is not a JSON object")
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return 0, 0, err
+		}
+		if key == name {
+			end := int(dec.InputOffset())
+			return end - len(value), end, nil
+		}
+	}
+	return -1, -1, nil
+}
+
+// marshalVerbatim encodes v like json.Marshal but without HTML escaping, so
+// raw values such as base64 or text content blocks pass through unchanged
+func marshalVerbatim(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
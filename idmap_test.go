@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIDMapperForgetsFailedRequests(t *testing.T) {
+	captureLog(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	c, out := newTestClient(t, url, map[string]string{"ARCPOINT_REWRITE_IDS": "true"})
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	// The server answering after the client already reported the
+	// connection error must not give the host a second response
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","id":"arcpoint-1","result":{}}`))
+	got := flushOutput(t, c, out)
+
+	if n := len(c.ids.toHost) + len(c.ids.toServer); n != 0 {
+		t.Errorf("id mapper still holds %d entries after the request failed", n)
+	}
+	if strings.Count(got, "\n") != 1 || !strings.Contains(got, "Connection error") {
+		t.Errorf("host should get only the connection error, got %q", got)
+	}
+}
+
+func TestCancelledNamesTheInternalID(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_REWRITE_IDS": "true"})
+	send(c, `{"jsonrpc":"2.0","id":5,"method":"tools/call","params":{"name":"slow"}}`)
+	send(c, `{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":5,"reason":"user"}}`)
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","id":"arcpoint-1","result":{}}`))
+	got := flushOutput(t, c, out)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("server received %d messages, want 2", len(bodies))
+	}
+	var cancelled struct {
+		Params struct {
+			RequestID json.RawMessage `json:"requestId"`
+			Reason    string          `json:"reason"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal([]byte(bodies[1]), &cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if string(cancelled.Params.RequestID) != `"arcpoint-1"` || cancelled.Params.Reason != "user" {
+		t.Errorf("cancellation sent as %s", bodies[1])
+	}
+	if got != "" {
+		t.Errorf("response to a cancelled request reached the host: %q", got)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// defaultLifetimeWarning is how far ahead a planned shutdown is announced
+const defaultLifetimeWarning = time.Minute
+
+// watchLifetime shuts the client down cleanly once it has run for
+// MaxLifetime, so a supervisor starts a fresh process with a new session.
+// The shutdown is announced LifetimeWarning ahead of time.
+func (c *SSEClient) watchLifetime(ctx context.Context) {
+	remaining := c.cfg.MaxLifetime
+	if warning := c.cfg.LifetimeWarning; warning > 0 && warning < remaining {
+		c.sleep(ctx, remaining-warning)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Planned shutdown in %s: the process reaches ARCPOINT_MAX_LIFETIME of %s", warning, c.cfg.MaxLifetime)
+		remaining = warning
+	}
+
+	c.sleep(ctx, remaining)
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("Reached ARCPOINT_MAX_LIFETIME of %s, shutting down", c.cfg.MaxLifetime)
+	c.stopWith(nil)
+}
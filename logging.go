@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+)
+
+// debugLogging enables debugf output, set from ARCPOINT_LOG_LEVEL
+var debugLogging bool
+
+// debugf logs only when debug logging is enabled
+func debugf(format string, args ...interface{}) {
+	if debugLogging {
+		log.Printf("[debug] "+format, args...)
+	}
+}
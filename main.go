@@ -3,30 +3,80 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const version = "1.0.2"
 
+// environmentURLs maps ARCPOINT_ENV shortcuts to their default API URLs.
+// Only endpoints with a published address are listed; anything else, such
+// as a staging deployment, is reached through ARCPOINT_API_URL.
+var environmentURLs = map[string]string{
+	"prod":  "https://mcp.arcpoint.ai",
+	"local": "http://localhost:8084",
+}
+
 func main() {
+	quiet := flag.Bool("quiet", false, "suppress all non-fatal logging on stderr (same as ARCPOINT_QUIET=true)")
+	flag.Parse()
+
+	// Fill in unset variables from a .env file for local development
+	if err := loadEnvFile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Get configuration from environment
 	apiToken := os.Getenv("ARCPOINT_API_TOKEN")
 	apiURL := os.Getenv("ARCPOINT_API_URL")
 
-	// Default to production if not specified
+	// Pick the default URL for the selected environment (production if not
+	// specified); an explicit ARCPOINT_API_URL still wins
+	env := strings.ToLower(strings.TrimSpace(os.Getenv("ARCPOINT_ENV")))
+	if env == "" {
+		env = "prod"
+	}
+	envURL, ok := environmentURLs[env]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown ARCPOINT_ENV %q (expected prod or local; set ARCPOINT_API_URL for other endpoints)\n", env)
+		os.Exit(1)
+	}
 	if apiURL == "" {
-		apiURL = "https://mcp.arcpoint.ai"
+		apiURL = envURL
+	}
+
+	// With several tokens, the first stands in wherever one is required
+	if apiToken == "" {
+		if tokens := envList("ARCPOINT_API_TOKENS"); len(tokens) > 0 {
+			apiToken = tokens[0]
+		}
+	}
+
+	// The token can also come from a file or command, e.g. a mounted secret
+	if apiToken == "" {
+		var err error
+		if apiToken, err = tokenFromSources(realClock{}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	// Validate required configuration
@@ -53,15 +103,80 @@ func main() {
 	// Ensure URL doesn't have trailing slash
 	apiURL = strings.TrimSuffix(apiURL, "/")
 
-	// Log startup to stderr (stdout is for JSON-RPC)
-	log.SetOutput(os.Stderr)
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Plain http exposes the bearer token to anyone on the network path
+	var insecureURLs []string
+	for _, u := range []string{apiURL, cfg.FallbackURL} {
+		if insecureURL(u) {
+			insecureURLs = append(insecureURLs, u)
+		}
+	}
+	if len(insecureURLs) > 0 && !cfg.AllowInsecureHTTP {
+		fmt.Fprintf(os.Stderr, "Error: %s uses plain http, which would send your API token unencrypted. Use https, or set ARCPOINT_ALLOW_INSECURE_HTTP=true to proceed anyway\n", insecureURLs[0])
+		os.Exit(1)
+	}
+
+	// Log startup to stderr (stdout is for JSON-RPC). Quiet mode silences
+	// everything except fatal errors, which are written directly below.
+	cfg.Quiet = cfg.Quiet || *quiet
+	if cfg.Quiet {
+		log.SetOutput(io.Discard)
+	} else {
+		log.SetOutput(os.Stderr)
+		debugLogging = cfg.LogLevel == "debug"
+		if cfg.InstanceLabel != "" {
+			log.SetPrefix(fmt.Sprintf("[instance=%s] ", cfg.InstanceLabel))
+			log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+		}
+		if cfg.LogFile != "" {
+			if f, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600); err != nil {
+				log.Printf("Warning: cannot open ARCPOINT_LOG_FILE, logging to stderr: %v", err)
+			} else {
+				log.SetOutput(f)
+			}
+		}
+	}
 	log.Printf("Arcpoint MCP Client v%s", version)
 	log.Printf("Connecting to: %s", apiURL)
+	if len(cfg.APITokens) > 1 {
+		masked := make([]string, len(cfg.APITokens))
+		for i, token := range cfg.APITokens {
+			masked[i] = maskToken(token)
+		}
+		log.Printf("Using %d tokens (%s): %s", len(masked), cfg.TokenPolicy, strings.Join(masked, ", "))
+	} else {
+		log.Printf("Using token: %s", maskToken(apiToken))
+	}
+	for _, u := range insecureURLs {
+		log.Printf("WARNING: %s uses plain http, so your API token is sent UNENCRYPTED", u)
+	}
+	if cfg.Proxy != nil {
+		log.Printf("Using proxy: %s", cfg.Proxy.Redacted())
+	}
+	if len(cfg.FidelityBypassed) > 0 {
+		log.Printf("Warning: ARCPOINT_BYTE_FIDELITY is set, ignoring %s so server payloads reach the host unchanged", strings.Join(cfg.FidelityBypassed, ", "))
+	}
+	if cfg.ChaosReconnectInterval > 0 {
+		log.Printf("Warning: ARCPOINT_CHAOS_RECONNECT_INTERVAL is set, the SSE stream will be torn down every %s. This is for testing only.", cfg.ChaosReconnectInterval)
+	}
 
 	// Set up context with cancellation for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	client := NewSSEClient(apiURL, apiToken, cfg)
+	if cfg.RecordPath != "" {
+		if err := client.startRecording(cfg.RecordPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Handle shutdown signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -69,48 +184,303 @@ func main() {
 		<-sigChan
 		log.Println("Shutting down...")
 		cancel()
+
+		// Don't let a wedged shutdown ignore the supervisor: force exit on
+		// a second signal or once the hard timeout expires
+		select {
+		case <-sigChan:
+			// Conventional exit status for a CLI killed by SIGINT
+			log.Println("Received second signal, exiting immediately")
+			os.Exit(130)
+		case <-client.clock.After(cfg.ShutdownHardTimeout):
+			log.Printf("Warning: shutdown did not complete within %s, forcing exit (%d in-flight requests abandoned)",
+				cfg.ShutdownHardTimeout, client.inFlight.Load())
+			os.Exit(1)
+		}
+	}()
+
+	// Dump the client's state on demand (SIGUSR1, where the platform has
+	// it) without affecting the connection
+	dumpChan := make(chan os.Signal, 1)
+	notifyStateDump(dumpChan)
+	go func() {
+		for range dumpChan {
+			client.dumpState()
+		}
 	}()
 
 	// Start the SSE client
-	client := NewSSEClient(apiURL, apiToken)
-	if err := client.Run(ctx); err != nil {
-		log.Fatalf("Client error: %v", err)
+	runErr := client.Run(ctx)
+
+	// Deliver any buffered responses before exiting
+	if err := client.Close(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	code := exitCode(runErr)
+	var exitErr *exitError
+	switch {
+	case code == 0:
+	case errors.As(runErr, &exitErr):
+		log.Printf("Exiting: %v", exitErr)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", runErr)
+	}
+	os.Exit(code)
+}
+
+// maskToken returns a form of token that is safe to log: the prefix up to
+// the first underscore and the last four characters. Tokens too short to
+// keep anything hidden are masked entirely.
+func maskToken(token string) string {
+	if token == "" {
+		return "(empty)"
+	}
+	prefix := ""
+	if i := strings.IndexByte(token, '_'); i >= 0 && i <= 8 {
+		prefix = token[:i+1]
 	}
+	secret := token[len(prefix):]
+	if len(secret) < 12 {
+		return prefix + "****"
+	}
+	return prefix + "****" + secret[len(secret)-4:]
 }
 
+// messageTimeout bounds a single message send, including retries and
+// reading its response, unless the request's own timeout hint is longer
+const messageTimeout = 30 * time.Second
+
 // SSEClient handles the SSE connection and stdio proxying
 type SSEClient struct {
 	baseURL    string
-	token      string
+	tokens     *tokenPool
+	cfg        Config
 	httpClient *http.Client
-	sessionID  string
-	mu         sync.RWMutex
+	msgClient  *http.Client
+	out        *outputWriter
+	chunks     *chunkReassembler
+	middleware []messageMiddleware
+	queue      *outgoingQueue
+	pending    *pendingRequests
+	stop       chan error
+	ids        *idMapper
+	clock      clock
+	// onFallback is set while connected to ARCPOINT_API_URL_FALLBACK, and
+	// switched is closed and replaced whenever that changes
+	onFallback atomic.Bool
+	switchMu   sync.Mutex
+	switched   chan struct{}
+	// watching is set while a watchPrimary goroutine is running
+	watching atomic.Bool
+	dedup    *dedupWindow
+	progress *progressCoalescer
+	inFlight atomic.Int64
+	// runCtx is Run's context, for sends that start outside the stdin
+	// reader, and replies tracks those sends so Close can wait for them
+	runCtx  context.Context
+	replies sync.WaitGroup
+	// streams are the SSE connections, the first of which also carries
+	// the Streamable HTTP session
+	streams  []*sseStream
+	metrics  *metrics
+	events   *eventLog
+	statusMu sync.Mutex
+	eventSeq atomic.Uint64
+	// routes maps the ids server requests are forwarded to the host under
+	// to the stream and id they arrived with
+	routes   map[string]serverRoute
+	routeSeq uint64
+	// protocolVersion is the version from the host's first initialize
+	protocolVersion string
+	// ready is closed once a session is available for host messages
+	ready     chan struct{}
+	readyOnce sync.Once
+	// stdinMessages counts messages received from the host
+	stdinMessages atomic.Int64
+	// hostSpoke is closed when the first message arrives from the host
+	hostSpoke     chan struct{}
+	hostSpokeOnce sync.Once
+	// recorder, if set, records the session for later replay. It is
+	// cleared from whichever goroutine fails to write to it.
+	recorder atomic.Pointer[sessionRecorder]
+	// lastEvent is when the last SSE event arrived, in Unix nanoseconds
+	lastEvent atomic.Int64
+	mu        sync.RWMutex
 }
 
 // NewSSEClient creates a new SSE client
-func NewSSEClient(baseURL, token string) *SSEClient {
-	return &SSEClient{
+func NewSSEClient(baseURL, token string, cfg Config) *SSEClient {
+	return newClientWithClock(baseURL, token, cfg, realClock{})
+}
+
+// newClientWithClock creates a client that takes all its timing from clk,
+// so tests can drive timers without real sleeps
+func newClientWithClock(baseURL, token string, cfg Config, clk clock) *SSEClient {
+	// Both transports share a dialer so outbound traffic can be pinned to
+	// a local address
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.LocalAddr != nil {
+		dialer.LocalAddr = cfg.LocalAddr
+	}
+
+	msgTransport := http.DefaultTransport.(*http.Transport).Clone()
+	msgTransport.DialContext = dialer.DialContext
+
+	// net/http sends the proxy URL's credentials as Proxy-Authorization
+	// (or SOCKS5 authentication) without them ever being logged
+	sseTransport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true, // SSE doesn't work well with compression
+		DisableKeepAlives:   false,
+		MaxIdleConnsPerHost: 5,
+	}
+	if cfg.Proxy != nil {
+		sseTransport.Proxy = http.ProxyURL(cfg.Proxy)
+		msgTransport.Proxy = http.ProxyURL(cfg.Proxy)
+	}
+
+	// ARCPOINT_API_TOKENS, when set, replaces the single token
+	tokens := []string{token}
+	if len(cfg.APITokens) > 0 {
+		tokens = cfg.APITokens
+	}
+
+	c := &SSEClient{
 		baseURL: baseURL,
-		token:   token,
+		tokens:  newTokenPool(tokens, cfg.TokenPolicy),
+		cfg:     cfg,
 		httpClient: &http.Client{
-			Timeout: 0, // No timeout for SSE connection
-			Transport: &http.Transport{
-				MaxIdleConns:        10,
-				IdleConnTimeout:     90 * time.Second,
-				DisableCompression:  true, // SSE doesn't work well with compression
-				DisableKeepAlives:   false,
-				MaxIdleConnsPerHost: 5,
-			},
+			Timeout:   0, // No timeout for SSE connection
+			Transport: sseTransport,
 		},
+		// Shared client for message sending, so pooled connections are
+		// reused across requests. Each request's context carries its
+		// deadline, since a hinted timeout can outlast messageTimeout.
+		msgClient: &http.Client{
+			Transport: msgTransport,
+		},
+		out:       newOutputWriter(os.Stdout, cfg.OutputEOL, cfg.SanitizeOutput, cfg.ByteFidelity, clk),
+		chunks:    newChunkReassembler(cfg.MaxResponseBytes, clk),
+		metrics:   newMetrics(clk),
+		events:    newEventLog(cfg.EventLogSize),
+		streams:   newStreams(cfg.Streams, cfg.FailureLogInterval, clk),
+		routes:    make(map[string]serverRoute),
+		pending:   newPendingRequests(cfg.LateResponseWindow, clk),
+		stop:      make(chan error, 1),
+		ready:     make(chan struct{}),
+		hostSpoke: make(chan struct{}),
+		ids:       newIDMapper(),
+		queue:     newOutgoingQueue(),
+		clock:     clk,
+		switched:  make(chan struct{}),
+		dedup:     newDedupWindow(cfg.DedupWindow, clk),
+		runCtx:    context.Background(),
+	}
+	c.progress = newProgressCoalescer(cfg.ProgressInterval, clk, c.out.WriteLine)
+	return c
+}
+
+// Close flushes buffered output. Streamable HTTP sessions are optionally
+// terminated first, and both share the one shutdown grace period.
+func (c *SSEClient) Close() error {
+	started := c.clock.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.ShutdownGrace)
+	defer cancel()
+	c.awaitReplies(ctx)
+	if c.cfg.Transport == transportStreamableHTTP && c.cfg.DeleteSessionOnExit {
+		c.terminateSession(ctx)
+	}
+	return c.out.Close(c.cfg.ShutdownGrace - c.clock.Now().Sub(started))
+}
+
+// awaitReplies waits until ctx is done for replies the client is posting
+// on its own behalf, such as refusals of server requests
+func (c *SSEClient) awaitReplies(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		c.replies.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Warning: gave up waiting for replies to server requests")
 	}
 }
 
 // Run starts the SSE connection and stdio proxy
 func (c *SSEClient) Run(ctx context.Context) error {
-	// Start reading from stdin and sending messages
-	go c.readStdin(ctx)
+	c.runCtx = ctx
+	// A replay stands in for both the server and the stdin reader
+	if c.cfg.ReplayPath != "" {
+		return c.replay(ctx)
+	}
+
+	// Start reading from stdin and sending messages. Each message is posted
+	// before the next is read, so a final one without a trailing newline is
+	// sent before stdinClosed can shut the client down.
+	go func() {
+		c.readStdin(ctx)
+		c.stdinClosed(ctx)
+	}()
 
-	// Keep reconnecting SSE connection if it drops
+	if c.cfg.KeepalivePostInterval > 0 {
+		go c.keepalivePost(ctx)
+	}
+
+	if c.cfg.IdleStdinTimeout > 0 {
+		go c.watchIdleStdin(ctx)
+	}
+
+	if c.cfg.HostKeepaliveInterval > 0 {
+		go c.hostKeepalive(ctx)
+	}
+
+	if c.cfg.MaxLifetime > 0 {
+		go c.watchLifetime(ctx)
+	}
+
+	// Streamable HTTP carries responses on the message POSTs themselves,
+	// so there is no long-lived stream to maintain
+	if c.cfg.Transport == transportStreamableHTTP {
+		c.markSessionReady()
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-c.stop:
+			return err
+		}
+	}
+
+	// Each stream reconnects independently. The first to give up ends Run,
+	// taking the others down with it.
+	streamsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.streams))
+	for _, s := range c.streams {
+		go func() { errs <- c.runStream(streamsCtx, s) }()
+	}
+	select {
+	case err := <-errs:
+		return err
+	case err := <-c.stop:
+		return err
+	}
+}
+
+// runStream keeps one SSE stream connected, reconnecting when it drops
+func (c *SSEClient) runStream(ctx context.Context, s *sseStream) error {
+	initialAttempts := 0
+	budget := newReconnectBudget(c.cfg.MaxReconnects, c.cfg.ReconnectWindow)
+	short := newShortConnections()
+	// failed counts consecutive attempts that never established a session,
+	// for failing over to ARCPOINT_API_URL_FALLBACK
+	failed := 0
 	for {
 		select {
 		case <-ctx.Done():
@@ -118,37 +488,209 @@ func (c *SSEClient) Run(ctx context.Context) error {
 		default:
 		}
 
-		log.Println("Connecting to SSE stream...")
-		err := c.connectSSE(ctx)
+		attempt := c.metrics.recordAttempt()
+		if !s.failures.coalescing() {
+			log.Printf("%sConnecting to SSE stream (%s)...", s.label, c.metrics.attemptSummary(attempt))
+		}
+		c.recordEvent(connEvent{Kind: "connecting", Stream: s.path})
+		var err error
+		if c.cfg.Preflight && !s.connectedOnce.Load() {
+			err = c.preflight(ctx)
+		}
+		sessions, fallback := s.endpointEvents.Load(), c.onFallback.Load()
+		if err == nil {
+			err = c.connectSSE(ctx, s)
+		}
+		if s.endpointEvents.Load() != sessions || c.onFallback.Load() != fallback {
+			failed = 0
+		}
 		if err != nil {
 			if ctx.Err() != nil {
 				// Context cancelled, exit cleanly
 				return nil
 			}
-			log.Printf("SSE connection error: %v, reconnecting in 2s...", err)
-			time.Sleep(2 * time.Second)
+			c.recordEvent(connEvent{Kind: "disconnected", Stream: s.path, Reason: reconnectReason(err), Error: err.Error()})
+
+			// Another stream switched backends, so follow it straight away
+			if errors.Is(err, errBackendSwitch) {
+				failed = 0
+				c.metrics.recordReconnect(reasonBackendSwitch)
+				log.Printf("%sReconnecting to %s (reconnect reason: %s)", s.label, c.base(), reasonBackendSwitch)
+				continue
+			}
+
+			// The server told us to stop, so don't reconnect
+			var exitErr *exitError
+			if errors.As(err, &exitErr) {
+				return err
+			}
+
+			// Retrying won't fix a URL that points at something else
+			if errors.Is(err, errNotEventStream) {
+				return fmt.Errorf("%s%s: %w - check ARCPOINT_API_URL", c.base(), s.path, err)
+			}
+
+			// With ARCPOINT_STRICT_ENDPOINT, a server that can't advertise a
+			// usable endpoint is treated as misconfigured
+			if errors.Is(err, errMalformedEndpoint) {
+				return fmt.Errorf("%s%s: %w", c.base(), s.path, err)
+			}
+
+			// Retrying won't fix a bad certificate
+			if isCertificateError(err) {
+				return fmt.Errorf("TLS error connecting to %s%s: %s: %w", c.base(), s.path, tlsDiagnosis(err), err)
+			}
+
+			if failed++; c.cfg.FallbackURL != "" && failed >= c.cfg.FailoverAfter {
+				c.failover(ctx, fallback, failed)
+				failed = 0
+				budget = newReconnectBudget(c.cfg.MaxReconnects, c.cfg.ReconnectWindow)
+				continue
+			}
+
+			// Until the first connection succeeds the backend may simply
+			// not be reachable yet (e.g. DNS/VPN still coming up at boot)
+			if !s.connectedOnce.Load() {
+				initialAttempts++
+				if c.cfg.InitialConnectRetries > 0 && initialAttempts > c.cfg.InitialConnectRetries {
+					return fmt.Errorf("could not reach %s%s after %d attempts: %w (check your network connection and ARCPOINT_API_URL)",
+						c.base(), s.path, initialAttempts, err)
+				}
+				delay := initialConnectDelay(initialAttempts)
+				// Repeated identical failures are coalesced into periodic
+				// summaries by the failure log
+				if s.failures.failure(s.label, err.Error()) {
+					if isDNSError(err) {
+						log.Printf("%sCannot resolve host - check DNS/network (attempt %d): %v, retrying in %s...", s.label, initialAttempts, err, delay)
+					} else if diagnosis := tlsDiagnosis(err); diagnosis != "" {
+						log.Printf("%sTLS error - %s (attempt %d): %v, retrying in %s...", s.label, diagnosis, initialAttempts, err, delay)
+					} else {
+						log.Printf("%sWaiting for backend to become reachable (attempt %d): %v, retrying in %s...", s.label, initialAttempts, err, delay)
+					}
+				}
+				c.sleep(ctx, delay)
+				continue
+			}
+
+			reason := reconnectReason(err)
+			if reason == reasonChaos {
+				c.metrics.recordReconnect(reason)
+				log.Printf("%s[chaos] Forcing reconnect after %s (reconnect reason: %s)", s.label, c.cfg.ChaosReconnectInterval, reason)
+				c.runReconnectCommand(s, reason, err)
+				continue
+			}
+			if reason == reasonMaxAge || reason == reasonVersionChange {
+				// A planned recycle, so reconnect straight away without
+				// spending the reconnect budget
+				c.metrics.recordReconnect(reason)
+				log.Printf("%s%v, reconnecting (reconnect reason: %s)", s.label, err, reason)
+				c.runReconnectCommand(s, reason, err)
+				continue
+			}
+			if err := c.noteReconnect(budget, reason); err != nil {
+				if c.cfg.FallbackURL == "" {
+					return err
+				}
+				// Rather than give up, try the other backend
+				log.Printf("%s%v", s.label, err)
+				c.failover(ctx, fallback, failed)
+				failed = 0
+				budget = newReconnectBudget(c.cfg.MaxReconnects, c.cfg.ReconnectWindow)
+				continue
+			}
+			c.runReconnectCommand(s, reason, err)
+
+			// DNS failures usually mean there's no network at all, so
+			// back off for longer before trying again
+			delay := 2 * time.Second
+			if reason == reasonDNSError {
+				delay = 10 * time.Second
+			}
+			if s.failures.failure(s.label, err.Error()) {
+				if reason == reasonDNSError {
+					log.Printf("%sCannot resolve host - check DNS/network: %v (reconnect reason: %s), reconnecting in %s...", s.label, err, reason, delay)
+				} else if diagnosis := tlsDiagnosis(err); diagnosis != "" {
+					log.Printf("%sTLS error - %s: %v (reconnect reason: %s), reconnecting in %s...", s.label, diagnosis, err, reason, delay)
+				} else {
+					log.Printf("%sSSE connection error: %v (reconnect reason: %s), reconnecting in %s...", s.label, err, reason, delay)
+				}
+			}
+			c.sleep(ctx, delay)
 			continue
 		}
 
 		// Connection closed cleanly, try to reconnect
 		if ctx.Err() == nil {
-			log.Println("SSE connection closed, reconnecting in 2s...")
-			time.Sleep(2 * time.Second)
+			c.recordEvent(connEvent{Kind: "disconnected", Stream: s.path, Reason: reasonCleanClose})
+			if err := c.noteReconnect(budget, reasonCleanClose); err != nil {
+				return err
+			}
+			c.runReconnectCommand(s, reasonCleanClose, nil)
+			delay := 2 * time.Second
+			age := c.clock.Now().Sub(time.Unix(0, s.connectedAt.Load()))
+			if short.closed(c.clock.Now(), age) {
+				if !short.warned {
+					log.Printf("%sWarning: more than %d SSE connections in %s were closed by the server within %s of opening; it may not support long-lived SSE streams",
+						s.label, shortConnectionCount, shortConnectionWindow, shortConnectionAge)
+					short.warned = true
+				}
+				delay = max(delay, c.cfg.ShortConnectionDelay)
+			}
+			log.Printf("%sSSE connection closed (reconnect reason: %s), reconnecting in %s...", s.label, reasonCleanClose, delay)
+			c.sleep(ctx, delay)
 		}
 	}
 }
 
-// connectSSE establishes and maintains the SSE connection
-func (c *SSEClient) connectSSE(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/sse", nil)
+// noteReconnect counts a reconnect and fails once the sliding-window
+// reconnect budget is exhausted
+func (c *SSEClient) noteReconnect(budget *reconnectBudget, reason string) error {
+	c.metrics.recordReconnect(reason)
+	if !budget.spend(c.clock.Now()) {
+		return fmt.Errorf("more than %d reconnects within %s (last reason: %s), giving up",
+			c.cfg.MaxReconnects, c.cfg.ReconnectWindow, reason)
+	}
+	return nil
+}
+
+// initialConnectDelay returns the exponential backoff before the given
+// initial connection attempt is retried: 1s, 2s, 4s... capped at 30s
+func initialConnectDelay(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < 30*time.Second; i++ {
+		delay *= 2
+	}
+	return min(delay, 30*time.Second)
+}
+
+// connectSSE establishes and maintains one SSE connection
+func (c *SSEClient) connectSSE(ctx context.Context, s *sseStream) error {
+	// Watchdogs cancel the connection with a cause so Run can tell why it
+	// was dropped
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Snapshot the backend so a switch while connecting still cancels this
+	// connection
+	switched := c.backendSwitched()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base()+s.path, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create SSE request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	token := c.tokens.pick()
+	s.setToken(token)
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Cache-Control", "no-cache")
+	// The transport already skips gzip; saying so stops intermediaries such
+	// as CDNs compressing the stream anyway
+	req.Header.Set("Accept-Encoding", "identity")
 	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+	if c.cfg.ConnectionName != "" {
+		req.Header.Set("X-Connection-Name", c.cfg.ConnectionName)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -157,78 +699,521 @@ func (c *SSEClient) connectSSE(ctx context.Context) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		c.tokens.noteStatus(token, resp.StatusCode)
+		c.recordEvent(connEvent{Kind: "rejected", Stream: s.path, Status: resp.StatusCode})
 		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("SSE connection failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	log.Println("SSE stream connected")
+	s.failures.connected(s.label)
+	log.Printf("%sSSE stream connected", s.label)
+	s.resetFragments()
+	s.connectedOnce.Store(true)
+	s.connected.Store(true)
+	defer s.connected.Store(false)
+	// The session ends with the stream, so host messages wait for the next
+	// one instead of being posted to a session the server has dropped
+	defer func() {
+		s.setEndpoint("")
+		s.setSessionID("")
+	}()
+	defer func() { s.markOutage(c.clock.Now()) }()
+	c.metrics.recordConnected()
+	c.recordEvent(connEvent{Kind: "connected", Stream: s.path, Status: resp.StatusCode})
+
+	if c.cfg.EndpointTimeout > 0 {
+		// A server back from a long outage may still be warming up, so it
+		// gets longer to send the endpoint until a session is established
+		timeout := c.cfg.EndpointTimeout
+		if outage := s.outage(c.clock.Now()); outage >= prolongedOutage && c.cfg.EndpointColdStartTimeout > timeout {
+			timeout = c.cfg.EndpointColdStartTimeout
+			log.Printf("%sDisconnected for %s, allowing %s for the endpoint event while the server warms up",
+				s.label, outage.Round(time.Second), timeout)
+		}
+		seen := s.endpointEvents.Load()
+		endpointTimer := c.clock.AfterFunc(timeout, func() {
+			if s.endpointEvents.Load() == seen {
+				cancel(errEndpointTimeout)
+			}
+		})
+		defer endpointTimer.Stop()
+	}
+
+	// A 200 that isn't labelled as an event stream may be some other API
+	// entirely; give it a short window to prove otherwise
+	eventStream := isEventStream(resp)
+	frames := s.frames.Load()
+	if !eventStream {
+		detectTimer := c.clock.AfterFunc(sseDetectWindow, func() {
+			if s.frames.Load() == frames {
+				cancel(errNotEventStream)
+			}
+		})
+		defer detectTimer.Stop()
+	}
+	notEventStream := func() error {
+		return fmt.Errorf("%w (Content-Type %q)", errNotEventStream, resp.Header.Get("Content-Type"))
+	}
 
-	// Parse SSE events
-	scanner := bufio.NewScanner(resp.Body)
-	var eventType string
+	s.connectedAt.Store(c.clock.Now().UnixNano())
+	if c.cfg.MaxConnectionAge > 0 {
+		// Jittered like the idle timeout so clients that connected together
+		// don't all recycle together
+		ageTimer := c.clock.AfterFunc(jitter(c.cfg.MaxConnectionAge), func() { cancel(errMaxAge) })
+		defer ageTimer.Stop()
+	}
+	if c.cfg.FallbackURL != "" {
+		go func() {
+			select {
+			case <-switched:
+				cancel(errBackendSwitch)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if c.cfg.ChaosReconnectInterval > 0 {
+		chaosTimer := c.clock.AfterFunc(c.cfg.ChaosReconnectInterval, func() { cancel(errChaosReconnect) })
+		defer chaosTimer.Stop()
+	}
+
+	var onActivity func()
+	if c.cfg.IdleTimeout > 0 {
+		// Jitter the timeout so a fleet of clients doesn't reconnect in
+		// lockstep after a shared stall
+		timeout := jitter(c.cfg.IdleTimeout)
+		idleTimer := c.clock.AfterFunc(timeout, func() { cancel(errIdleTimeout) })
+		defer idleTimer.Stop()
+		onActivity = func() { idleTimer.Reset(timeout) }
+	}
+
+	if err := c.readEvents(s, resp.Body, onActivity, false); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) || errors.Is(err, errVersionChanged) || errors.Is(err, errMalformedEndpoint) || errors.Is(err, errUnusableEndpoint) {
+			return err
+		}
+		if errors.Is(context.Cause(ctx), errNotEventStream) {
+			return notEventStream()
+		}
+		if cause := context.Cause(ctx); errors.Is(cause, errIdleTimeout) || errors.Is(cause, errEndpointTimeout) || errors.Is(cause, errMaxAge) || errors.Is(cause, errChaosReconnect) || errors.Is(cause, errBackendSwitch) {
+			return cause
+		}
+		return fmt.Errorf("error reading SSE stream: %w", err)
+	}
+	if !eventStream && s.frames.Load() == frames {
+		return notEventStream()
+	}
+
+	return nil
+}
+
+// sseDetectWindow is how long a stream without an event-stream Content-Type
+// has to produce an SSE frame before it is rejected
+const sseDetectWindow = 5 * time.Second
+
+// jitter returns d randomly adjusted by up to ±10%
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 10
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+// readEvents parses SSE events for stream s from r until EOF, dispatching
+// each one. onActivity, if set, is called for every line received. Lines
+// may be arbitrarily long; events larger than the configured cap are
+// dropped. With drain set, a server version change doesn't stop reading:
+// the rest of the events are still dispatched and errVersionChanged is
+// returned at EOF.
+func (c *SSEClient) readEvents(s *sseStream, r io.Reader, onActivity func(), drain bool) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var eventType, eventID string
 	var eventData []string
+	var eventSize int64
+	var dropping bool
+	var versionChanged error
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for {
+		line, err := readLine(reader, c.cfg.MaxEventBytes)
+		if err == errLineTooLong {
+			if !dropping {
+				log.Printf("Dropping SSE event larger than %d bytes", c.cfg.MaxEventBytes)
+			}
+			dropping = true
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return versionChanged
+			}
+			return err
+		}
+		if onActivity != nil {
+			onActivity()
+		}
 
 		if line == "" {
 			// Empty line marks end of event
-			if eventType == "endpoint" && len(eventData) > 0 {
-				// Extract session ID from endpoint URL
-				endpointData := strings.Join(eventData, "\n")
-				c.extractSessionID(endpointData)
-				log.Printf("Session established: %s", c.getSessionID())
-			} else if eventType == "message" && len(eventData) > 0 {
-				// Forward message to stdout
-				messageData := strings.Join(eventData, "\n")
-				fmt.Println(messageData)
+			if !dropping {
+				if err := c.handleEvent(s, eventType, eventID, eventData); drain && errors.Is(err, errVersionChanged) {
+					versionChanged = err
+				} else if err != nil {
+					return err
+				}
 			}
 			eventType = ""
+			eventID = ""
 			eventData = nil
+			eventSize = 0
+			dropping = false
+			continue
+		}
+		if dropping {
 			continue
 		}
 
+		eventSize += int64(len(line))
+		if eventSize > c.cfg.MaxEventBytes {
+			log.Printf("Dropping SSE event larger than %d bytes", c.cfg.MaxEventBytes)
+			dropping = true
+			continue
+		}
 		if strings.HasPrefix(line, "event:") {
+			s.frames.Add(1)
 			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
 		} else if strings.HasPrefix(line, "data:") {
-			data := strings.TrimPrefix(line, "data:")
+			s.frames.Add(1)
+			data := trimSSEData(strings.TrimPrefix(line, "data:"), c.cfg.SSEDataTrim)
 			eventData = append(eventData, data)
+		} else if strings.HasPrefix(line, "id:") {
+			eventID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
 		}
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading SSE stream: %w", err)
+// trimSSEData removes leading whitespace from a data field's value as
+// ARCPOINT_SSE_DATA_TRIM selects: one space as the SSE standard says, all of
+// it, or none
+func trimSSEData(data, mode string) string {
+	switch mode {
+	case sseDataTrimAll:
+		return strings.TrimLeft(data, " \t")
+	case sseDataTrimNone:
+		return data
+	default:
+		return strings.TrimPrefix(data, " ")
 	}
+}
+
+// errLineTooLong is returned by readLine for a line over its limit
+var errLineTooLong = errors.New("line too long")
 
+// readLine reads one line without its terminator, growing its buffer as
+// needed instead of failing at a fixed token size. A line longer than max
+// is consumed and discarded, returning errLineTooLong.
+func readLine(r *bufio.Reader, max int64) (string, error) {
+	var buf []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if int64(len(buf)+len(chunk)) > max {
+				tooLong = true
+				buf = nil
+			} else {
+				buf = append(buf, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(buf) == 0) {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(buf), "\r\n"), nil
+}
+
+// handleEvent acts on a single complete SSE event. An error stops reading
+// the stream.
+func (c *SSEClient) handleEvent(s *sseStream, eventType, eventID string, eventData []string) error {
+	c.lastEvent.Store(c.clock.Now().UnixNano())
+	if eventType != "" || len(eventData) > 0 {
+		c.record(recordSSE, s.path, eventType, []byte(strings.Join(eventData, "\n")))
+	}
+	if c.cfg.RawSSE {
+		c.logRawEvent(eventType, eventData)
+	}
+	if eventType == "" && len(eventData) > 0 && strings.TrimSpace(strings.Join(eventData, "")) == "" {
+		// A bare "data:" event is a keepalive; its lines already reset the
+		// idle timeout, so there is nothing else to do
+		debugf("%sReceived empty keepalive event", s.label)
+		return nil
+	}
+	if eventType == "endpoint" && len(eventData) > 0 {
+		// Extract session ID from endpoint URL
+		endpointData := strings.Join(eventData, "\n")
+		endpoint, err := resolveEndpoint(c.base(), s.path, endpointData)
+		sessionID := extractSessionID(endpointData)
+		if err != nil && sessionID == "" {
+			// Not counted as an endpoint event, so the endpoint timeout
+			// still reconnects rather than leaving the stream sessionless.
+			// Without one, the stream reconnects now, with the usual
+			// backoff, since a valid endpoint may never follow.
+			c.metrics.recordMalformedEndpoint()
+			log.Printf("%sWarning: malformed endpoint event, no sessionId and not a usable URL: %s", s.label, c.redactedSnippet([]byte(endpointData)))
+			if c.cfg.StrictEndpoint {
+				return fmt.Errorf("%w: %v", errMalformedEndpoint, err)
+			}
+			if c.cfg.EndpointTimeout == 0 {
+				return errUnusableEndpoint
+			}
+			return nil
+		}
+		s.endpointEvents.Add(1)
+		if err != nil {
+			log.Printf("%sIgnoring advertised endpoint: %v", s.label, err)
+		} else {
+			s.setEndpoint(endpoint)
+		}
+		if sessionID != "" {
+			s.endOutage()
+		}
+		if sessionID != "" && sessionID == s.getSessionID() {
+			// Some servers resend the endpoint as a keepalive or after
+			// rebalancing without meaning to start a new session
+			debugf("%sIgnoring repeated endpoint event for session %s", s.label, c.logSessionID(sessionID))
+			return nil
+		}
+		if sessionID != "" {
+			s.setSessionID(sessionID)
+			c.markSessionReady()
+			if c.cfg.QueueSize > 0 {
+				go c.flushQueue(c.runCtx, s)
+			}
+		}
+		log.Printf("%sSession established: %s", s.label, c.logSessionID(s.getSessionID()))
+	} else if eventType == "message" && len(eventData) > 0 {
+		// Forward message to stdout
+		messageData := []byte(strings.Join(eventData, "\n"))
+		if c.cfg.ReassembleFragments {
+			if messageData = c.reassembleFragment(s, messageData); messageData == nil {
+				return nil
+			}
+		}
+		// Only responses are deduplicated; identical notifications, such
+		// as repeated list_changed, are legitimately sent more than once
+		if c.cfg.DedupResponses && parseMessage(messageData).isResponse() && c.dedup.seenBefore(c.dedupKey(s, eventID, messageData)) {
+			log.Printf("%sDropping duplicate SSE response", s.label)
+			return nil
+		}
+		if c.cfg.ChunkedResults {
+			var err error
+			if messageData, err = c.chunks.Accept(messageData); err != nil {
+				log.Printf("Dropping chunked message: %v", err)
+			}
+		}
+		if messageData != nil {
+			messageData = c.routeRequest(s, messageData)
+			c.forwardMessage(messageData)
+			return c.noteServerVersion(s, messageData)
+		}
+	} else if eventType == "control" && len(eventData) > 0 {
+		if err := c.noteServerVersion(s, []byte(strings.Join(eventData, "\n"))); err != nil {
+			return err
+		}
+		return c.handleControl(eventData)
+	}
 	return nil
 }
 
-// extractSessionID parses the endpoint URL to extract the session ID
-func (c *SSEClient) extractSessionID(endpoint string) {
+// forwardMessage writes a message from the server to stdout after passing
+// it through the inbound middleware chain
+func (c *SSEClient) forwardMessage(data []byte) {
+	// Restore the host's id first so middleware only ever sees host ids
+	if c.cfg.RewriteIDs {
+		if msg := parseMessage(data); msg.isResponse() {
+			restored, stale, err := c.ids.inbound(data, msg.ID)
+			if err != nil {
+				log.Printf("Failed to restore response id: %v", err)
+				return
+			}
+			// The host was already answered locally, by a timeout or
+			// connection error, or cancelled the request itself
+			if stale {
+				log.Printf("Dropping response %s for a request that is no longer outstanding", msg.ID)
+				return
+			}
+			data = restored
+		}
+	}
+
+	data, err := c.applyInbound(data)
+	if err != nil {
+		log.Printf("Inbound middleware error: %v", err)
+		c.writeError(nil, -32603, fmt.Sprintf("Middleware error: %s", err.Error()))
+		return
+	}
+
+	if c.cfg.StrictOutput && !isJSONRPCFrame(data) {
+		log.Printf("Dropping message that isn't a JSON-RPC 2.0 frame: %s", c.redactedSnippet(data))
+		return
+	}
+
+	// Each message in a batch is checked on its own, and only those that
+	// pass are forwarded
+	var kept [][]byte
+	if batch, ok := splitBatch(data); ok && len(batch) > 0 {
+		for _, item := range batch {
+			if item, ok := c.checkInbound(item); ok {
+				kept = append(kept, item)
+			}
+		}
+		if len(kept) == 0 {
+			return
+		}
+		if len(kept) < len(batch) {
+			data = joinBatch(kept)
+		}
+	} else if data, ok = c.checkInbound(data); !ok {
+		return
+	}
+
+	if c.cfg.SurfaceTrace {
+		data = surfaceTrace(data)
+	}
+	if c.cfg.CoalesceProgress {
+		msg := parseMessage(data)
+		if !c.progress.allow(msg, data) {
+			return
+		}
+		// Progress still held for the request would arrive after its result
+		if msg.isResponse() {
+			c.progress.finish(msg.ID)
+		} else {
+			for _, item := range kept {
+				if item := parseMessage(item); item.isResponse() {
+					c.progress.finish(item.ID)
+				}
+			}
+		}
+	}
+
+	c.out.WriteLine(data)
+}
+
+// checkInbound matches a message from the server against the requests
+// awaiting responses, returning it, possibly annotated, and whether it
+// should reach the host. Server requests refused under
+// ARCPOINT_RESPONSES_ONLY are answered with an error.
+func (c *SSEClient) checkInbound(data []byte) ([]byte, bool) {
+	msg := parseMessage(data)
+	if !c.tracksRequests() {
+		if msg.isResponse() {
+			c.pending.complete(msg.ID)
+		}
+		return data, true
+	}
+
+	if msg.isResponse() {
+		if req := c.pending.complete(msg.ID); req != nil {
+			if c.cfg.AnnotateTiming {
+				data = annotateRTT(data, c.clock.Now().Sub(req.started))
+			}
+			return data, true
+		}
+		// The host already received a timeout error for a late
+		// response, so forwarding it would contradict that
+		if c.pending.isLate(msg.ID) {
+			log.Printf("Dropping late response for timed out request %s", msg.ID)
+			return nil, false
+		}
+		if c.pending.isDuplicate(msg.ID) {
+			if c.cfg.OnDuplicateResponse == duplicateDrop {
+				log.Printf("Warning: dropping duplicate response for request %s", msg.ID)
+				return nil, false
+			}
+			log.Printf("Warning: server sent another response for request %s", msg.ID)
+		}
+		// Errors with a null id report a message the server couldn't
+		// parse, so they still go through
+		if c.cfg.ResponsesOnly && string(msg.ID) != "null" {
+			log.Printf("Warning: dropping response %s that matches no outstanding request", msg.ID)
+			return nil, false
+		}
+	} else if msg.isRequest() && c.cfg.ResponsesOnly {
+		log.Printf("Warning: refusing server request %s (%s), ARCPOINT_RESPONSES_ONLY is set", msg.ID, msg.Method)
+		c.refuseServerRequest(msg)
+		return nil, false
+	}
+	return data, true
+}
+
+// refuseServerRequest answers a server request the host will never see
+// with a method not found error, so the server isn't left waiting for it
+func (c *SSEClient) refuseServerRequest(msg rpcMessage) {
+	reply, err := marshalVerbatim(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      msg.ID,
+		"error": map[string]interface{}{
+			"code":    -32601,
+			"message": fmt.Sprintf("Method not found: %s is not accepted by this client", msg.Method),
+		},
+	})
+	if err != nil {
+		return
+	}
+	// Posting from the stream's reader would stall it for the round trip
+	c.replies.Add(1)
+	go func() {
+		defer c.replies.Done()
+		c.sendMessage(c.runCtx, reply, parseMessage(reply))
+	}()
+}
+
+// logRawEvent writes a parsed SSE event to stderr with a sequence number
+func (c *SSEClient) logRawEvent(eventType string, eventData []string) {
+	seq := c.eventSeq.Add(1)
+	if eventType == "" {
+		eventType = "(none)"
+	}
+	log.Printf("[sse #%d] event=%s data=%q", seq, eventType, c.redactSessionQuery(strings.Join(eventData, "\n")))
+}
+
+// extractSessionID parses the endpoint URL to extract the session ID,
+// returning "" if it has none
+func extractSessionID(endpoint string) string {
 	// Endpoint format: "/message?sessionId=xxx"
 	parts := strings.Split(endpoint, "sessionId=")
 	if len(parts) == 2 {
-		sessionID := strings.TrimSpace(parts[1])
-		c.setSessionID(sessionID)
+		return strings.TrimSpace(parts[1])
 	}
+	return ""
 }
 
-// setSessionID safely sets the session ID
+// setSessionID sets the session ID of the first stream, which Streamable
+// HTTP uses for its session
 func (c *SSEClient) setSessionID(id string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.sessionID = id
+	c.streams[0].setSessionID(id)
 }
 
-// getSessionID safely gets the session ID
+// getSessionID gets the session ID of the first stream
 func (c *SSEClient) getSessionID() string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.sessionID
+	return c.streams[0].getSessionID()
 }
 
 // readStdin reads JSON-RPC messages from stdin and sends them to the server
 func (c *SSEClient) readStdin(ctx context.Context) {
+	// The decoder has no fixed buffer, so it also serves unbounded mode
+	if c.cfg.StreamDecode || c.cfg.UnboundedStdin {
+		c.decodeStdin(ctx)
+		return
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024) // Support large messages
 
@@ -241,82 +1226,599 @@ func (c *SSEClient) readStdin(ctx context.Context) {
 
 		line := scanner.Bytes()
 		if len(line) == 0 {
+			// Some hosts send a blank line as a keepalive and expect one
+			// back
+			if c.cfg.EchoStdinKeepalive {
+				c.out.WriteLine(stdinKeepaliveReply)
+			}
 			continue
 		}
 
-		// Wait for session ID if not available yet
-		sessionID := c.getSessionID()
-		if sessionID == "" {
-			// Try a few times with backoff
-			for i := 0; i < 10 && sessionID == ""; i++ {
-				time.Sleep(100 * time.Millisecond)
-				sessionID = c.getSessionID()
-			}
-			if sessionID == "" {
-				log.Println("Warning: Session not established yet, attempting to send anyway")
+		c.handleOutbound(ctx, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			log.Printf("Error reading stdin: message from host exceeds 10MB (set ARCPOINT_UNBOUNDED_STDIN=true to lift the limit)")
+		} else {
+			log.Printf("Error reading stdin: %v", err)
+		}
+	}
+}
+
+// decodeStdin reads successive JSON values from stdin regardless of line
+// breaks, for hosts that put several messages on one line
+func (c *SSEClient) decodeStdin(ctx context.Context) {
+	decoder := json.NewDecoder(os.Stdin)
+
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err != io.EOF {
+				// The decoder can't resynchronise after a syntax error
+				log.Printf("Error decoding stdin: %v", err)
+				c.writeError(nil, -32700, fmt.Sprintf("Parse error: %s", err.Error()))
 			}
+			return
 		}
 
-		// Send message via POST
-		messageURL := c.baseURL + "/message"
-		if sessionID != "" {
-			messageURL += "?sessionId=" + sessionID
+		select {
+		case <-ctx.Done():
+			return
+		default:
 		}
 
-		req, err := http.NewRequestWithContext(ctx, "POST", messageURL, bytes.NewReader(line))
-		if err != nil {
-			log.Printf("Failed to create request: %v", err)
+		c.handleOutbound(ctx, raw)
+	}
+}
+
+// handleOutbound passes one message from the host through the middleware
+// chain and sends it to the server
+func (c *SSEClient) handleOutbound(ctx context.Context, line []byte) {
+	c.stdinMessages.Add(1)
+	c.hostSpokeOnce.Do(func() { close(c.hostSpoke) })
+	c.record(recordStdin, "", "", line)
+	// A bare value such as true, 42 or "hello" is valid JSON but can never
+	// be a JSON-RPC message, so answer it here instead of posting it
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] != '{' && trimmed[0] != '[' && json.Valid(trimmed) {
+		log.Printf("Rejecting stdin line that isn't a JSON-RPC object or batch: %s", c.redactedSnippet(trimmed))
+		c.writeError(json.RawMessage("null"), -32600, "Invalid Request: expected a JSON-RPC object or batch")
+		return
+	}
+	ctx = withCorrelationID(ctx)
+	data, err := c.applyOutbound(line)
+	if err != nil {
+		log.Printf("Outbound middleware error: %v", err)
+		c.writeError(parseMessage(line).ID, -32603, fmt.Sprintf("Middleware error: %s", err.Error()))
+		return
+	}
+
+	// Batches have no method of their own, so each element is checked
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if data = c.permittedBatch(trimmed); data == nil {
+			return
+		}
+	}
+
+	msg := parseMessage(data)
+	if msg.Method != "" && !c.methodPermitted(msg.Method) {
+		log.Printf("Refusing %s: method not permitted by ARCPOINT_ALLOWED_METHODS/ARCPOINT_BLOCKED_METHODS", msg.Method)
+		if msg.isRequest() {
+			c.writeError(msg.ID, -32601, fmt.Sprintf("Method not permitted: %s", msg.Method))
+		}
+		return
+	}
+	if msg.Method == "initialize" && msg.isRequest() {
+		c.noteInitialize(msg)
+	}
+	if msg.Method == "initialize" && c.cfg.SendClientEnv {
+		if withEnv, err := addParamsMeta(data, clientEnvMeta()); err != nil {
+			log.Printf("Failed to add client environment to initialize: %v", err)
+		} else {
+			data = withEnv
+		}
+	}
+
+	// Requests are tracked even without a response timeout so shutdown on
+	// stdin EOF can wait for their responses, unless that is turned off
+	if msg.isRequest() && (c.tracksRequests() || c.tracksForEOF()) {
+		c.trackRequest(msg)
+		if c.cfg.CoalesceProgress {
+			c.progress.watch(msg)
+		}
+	}
+
+	// Requests are tracked and reported under the host's id, but go to the
+	// server under an internal one
+	if msg.isRequest() && c.cfg.RewriteIDs {
+		if data, err = c.ids.outbound(data, msg.ID); err != nil {
+			c.failRequest(msg.ID, -32603, fmt.Sprintf("Failed to rewrite request id: %s", err.Error()))
+			return
+		}
+	}
+	if msg.Method == "notifications/cancelled" && c.cfg.RewriteIDs {
+		data = c.cancelledForServer(data, msg)
+	}
+
+	ctx = withTrace(ctx, msg, c.cfg.Tracing)
+
+	if debugLogging {
+		correlation, _ := correlationID(ctx)
+		debugf("Sending %s (id %s, correlation %s)", msg.Method, msg.ID, correlation)
+		if trace, ok := traceFromContext(ctx); ok {
+			debugf("Trace %s for %s (id %s)", trace.traceID(), msg.Method, msg.ID)
+		}
+	}
+	c.sendMessage(ctx, data, msg)
+}
+
+// cancelledForServer rewrites a host's notifications/cancelled to name the
+// internal id its request was sent under. The request will get no response
+// the host wants, so its mapping is dropped and any response discarded.
+func (c *SSEClient) cancelledForServer(data []byte, msg rpcMessage) []byte {
+	var params struct {
+		RequestID json.RawMessage `json:"requestId"`
+	}
+	if json.Unmarshal(msg.Params, &params) != nil || len(params.RequestID) == 0 {
+		return data
+	}
+	internal, ok := c.ids.serverID(params.RequestID)
+	if !ok {
+		return data
+	}
+	rewritten, err := replaceCancelledID(data, internal)
+	if err != nil {
+		log.Printf("Failed to rewrite cancelled request id: %v", err)
+		return data
+	}
+	c.ids.forget(params.RequestID)
+	return rewritten
+}
+
+// methodPermitted reports whether the method policy lets method through.
+// A blocked method is always refused; when an allow list is set, only the
+// methods on it are permitted.
+func (c *SSEClient) methodPermitted(method string) bool {
+	if c.cfg.BlockedMethods[method] {
+		return false
+	}
+	return c.cfg.AllowedMethods == nil || c.cfg.AllowedMethods[method]
+}
+
+// permittedBatch removes the messages the method policy refuses from a
+// batch, answering each refused request with an error, and returns the
+// rest, or nil if nothing is left to send. Data that isn't a valid batch is
+// returned unchanged for the server to reject.
+func (c *SSEClient) permittedBatch(data []byte) []byte {
+	if c.cfg.AllowedMethods == nil && len(c.cfg.BlockedMethods) == 0 {
+		return data
+	}
+	batch, ok := splitBatch(data)
+	if !ok {
+		return data
+	}
+	kept := make([][]byte, 0, len(batch))
+	for _, item := range batch {
+		msg := parseMessage(item)
+		if msg.Method != "" && !c.methodPermitted(msg.Method) {
+			log.Printf("Refusing %s in batch: method not permitted by ARCPOINT_ALLOWED_METHODS/ARCPOINT_BLOCKED_METHODS", msg.Method)
+			if msg.isRequest() {
+				c.writeError(msg.ID, -32601, fmt.Sprintf("Method not permitted: %s", msg.Method))
+			}
 			continue
 		}
+		kept = append(kept, item)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	if len(kept) == len(batch) {
+		return data
+	}
+	return joinBatch(kept)
+}
+
+// sendMessage POSTs a single JSON-RPC message to the server and forwards any
+// immediate response to stdout. Errors are reported to the host against the
+// message's id.
+func (c *SSEClient) sendMessage(ctx context.Context, line []byte, msg rpcMessage) {
+	stream, line := c.streamFor(msg, line)
+	if c.holdMessage(ctx, stream, line, msg) {
+		return
+	}
+	c.postToStream(ctx, stream, line, msg)
+}
+
+// postToStream POSTs a message to stream's session
+func (c *SSEClient) postToStream(ctx context.Context, stream *sseStream, line []byte, msg rpcMessage) {
+	// Each send gets its own deadline so one slow POST is cancelled without
+	// affecting others, while cancelling ctx still stops every send
+	ctx, cancel := context.WithTimeout(ctx, c.sendTimeout(msg))
+	defer cancel()
+
+	id := msg.ID
+	streamable := c.cfg.Transport == transportStreamableHTTP
+
+	// Wait for session ID if not available yet. Streamable HTTP sessions
+	// are assigned by the server in response to initialize instead.
+	sessionID := stream.getSessionID()
+	if sessionID == "" && !streamable {
+		// Try a few times with backoff
+		for i := 0; i < 10 && sessionID == ""; i++ {
+			c.clock.Sleep(100 * time.Millisecond)
+			sessionID = stream.getSessionID()
+		}
+		if sessionID == "" {
+			log.Println("Warning: Session not established yet, attempting to send anyway")
+		}
+	}
 
-		req.Header.Set("Authorization", "Bearer "+c.token)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	// Send message via POST
+	messageURL := c.base() + "/message"
+	if streamable {
+		messageURL = c.base() + c.cfg.MCPPath
+	} else if endpoint := stream.getEndpoint(); endpoint != "" {
+		messageURL = endpoint
+		if c.cfg.SessionHeader != "" {
+			messageURL = withoutSessionQuery(messageURL)
+		}
+	} else if sessionID != "" && c.cfg.SessionHeader == "" {
+		messageURL += "?sessionId=" + sessionID
+	}
 
-		// Create a new client with timeout for message sending
-		msgClient := &http.Client{Timeout: 30 * time.Second}
-		resp, err := msgClient.Do(req)
+	// A legacy SSE session belongs to the token its stream connected with,
+	// so its POSTs stay on that token whatever the pool would pick next
+	var token string
+	if !streamable {
+		token = stream.getToken()
+	}
+
+	// A response lost partway through is a transport failure: the request
+	// is sent again if retries are enabled and it's safe to repeat. Resends
+	// and POST retries share one budget of retries.
+	var resp *http.Response
+	var body []byte
+	retries := c.postRetries(msg)
+	left := retries
+	for {
+		var err error
+		var used int
+		started := c.clock.Now()
+		resp, used, err = c.postWithRetry(ctx, messageURL, line, msg, sessionID, token, left)
+		left -= used
+		// Only the method, id and status are logged, never the body
 		if err != nil {
-			log.Printf("Request failed: %v", err)
-			c.writeError(-32603, fmt.Sprintf("Connection error: %s", err.Error()))
-			continue
+			debugf("POST %s (id %s) failed after %s", msg.Method, id, c.clock.Now().Sub(started).Round(time.Millisecond))
+		} else {
+			debugf("POST %s (id %s) -> %d in %s", msg.Method, id, resp.StatusCode, c.clock.Now().Sub(started).Round(time.Millisecond))
+		}
+		if err != nil {
+			// net/http errors include the URL, and with it the session id
+			reason := c.redactSessionQuery(err.Error())
+			if diagnosis := tlsDiagnosis(err); diagnosis != "" {
+				log.Printf("Request failed with TLS error - %s: %s", diagnosis, reason)
+			} else {
+				log.Printf("Request failed: %s", reason)
+			}
+			if c.cfg.OfflineInit && msg.Method == "initialize" && msg.isRequest() {
+				c.writeOfflineInitialize(msg)
+				return
+			}
+			c.failRequest(id, -32603, fmt.Sprintf("Connection error: %s", reason))
+			return
+		}
+
+		if streamable {
+			c.updateStreamableSession(resp)
 		}
 
 		// For SSE transport, we expect 202 Accepted (response comes via SSE)
-		// or 200 OK with immediate response
-		if resp.StatusCode == http.StatusAccepted {
+		// or 200 OK with immediate response. 204 No Content likewise has
+		// nothing to forward.
+		if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusNoContent {
 			resp.Body.Close()
 			// Response will come via SSE
-			continue
+			return
+		}
+
+		// Streamable HTTP servers may answer with an event stream instead of a
+		// single JSON body
+		if streamable && resp.StatusCode == http.StatusOK && isEventStream(resp) {
+			// The whole response is read even if the server's version
+			// changes partway, since it may still carry the result
+			err := c.readEvents(stream, resp.Body, nil, true)
+			resp.Body.Close()
+			var exitErr *exitError
+			if errors.As(err, &exitErr) {
+				c.stopWith(err)
+			} else if errors.Is(err, errVersionChanged) {
+				// There is no stream to reconnect, but pooled connections
+				// may still lead to the old backend
+				log.Println("Closing pooled connections so later requests reach the new server version")
+				c.msgClient.CloseIdleConnections()
+			} else if err != nil && ctx.Err() == nil {
+				log.Printf("Error reading response stream: %v", err)
+			}
+			return
 		}
 
-		// Read immediate response
-		body, err := io.ReadAll(resp.Body)
+		// Read immediate response, bounded so a misbehaving server can't
+		// exhaust memory. net/http has already undone any chunked transfer
+		// encoding, so the cap applies to the decoded body whether or not the
+		// response had a Content-Length.
+		// The transport only decodes gzip it asked for itself, and some
+		// servers or proxies compress regardless. An empty body may still
+		// carry the header, with or without a Content-Length, so it's left
+		// alone.
+		var reader io.Reader = resp.Body
+		if resp.ContentLength != 0 && strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+			if gz, gzErr := gzip.NewReader(resp.Body); gzErr == nil {
+				reader = gz
+			} else if gzErr != io.EOF {
+				err = gzErr
+			}
+		}
+		if err == nil {
+			body, err = io.ReadAll(io.LimitReader(reader, c.cfg.MaxResponseBytes+1))
+		}
 		resp.Body.Close()
+		if err == nil {
+			break
+		}
+		if left <= 0 || !safeToResend(msg) || ctx.Err() != nil {
+			log.Printf("Failed to read response: %v", err)
+			c.failRequest(id, -32006, fmt.Sprintf("Transport error reading response: %s", err.Error()))
+			return
+		}
+		left--
+		log.Printf("Failed to read response (%v), resending %s (retry %d/%d)", err, msg.Method, retries-left, retries)
+	}
+	if resp.StatusCode == http.StatusOK {
+		c.record(recordResponse, "", "", body)
+	}
+
+	if int64(len(body)) > c.cfg.MaxResponseBytes {
+		log.Printf("Response exceeded %d bytes, discarding", c.cfg.MaxResponseBytes)
+		c.failRequest(id, -32603, fmt.Sprintf("Response too large (limit %d bytes)", c.cfg.MaxResponseBytes))
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("HTTP error %d: %s", resp.StatusCode, string(body))
+		c.writeHTTPError(id, resp.StatusCode)
+		return
+	}
+
+	// A proxy or misbehaving server can answer 200 with something that
+	// isn't JSON-RPC at all (e.g. an HTML error page), which would corrupt
+	// the host's stream if forwarded
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return
+	}
+	if !json.Valid(trimmed) || (trimmed[0] != '{' && trimmed[0] != '[') {
+		snippet := c.redactedSnippet(trimmed)
+		log.Printf("Server returned an invalid JSON-RPC response: %s", snippet)
+		c.failRequest(id, -32603, fmt.Sprintf("Invalid response from server: %s", snippet))
+		return
+	}
 
+	// Forward immediate response to stdout
+	c.forwardMessage(body)
+}
+
+// redactedSnippet returns the start of a response body with whitespace
+// collapsed and the API token removed, safe to log and report to the host
+func (c *SSEClient) redactedSnippet(body []byte) string {
+	const maxSnippet = 120
+	text := strings.Join(strings.Fields(string(body)), " ")
+	text = c.tokens.redact(text)
+	if len(text) > maxSnippet {
+		text = strings.ToValidUTF8(text[:maxSnippet], "") + "..."
+	}
+	return text
+}
+
+// postRetries returns how many times a message POST may be retried: the
+// message's params._meta.maxRetries if it is safe to resend and has one,
+// else ARCPOINT_POST_RETRIES. Retries stop early once the next would start
+// past the send deadline.
+func (c *SSEClient) postRetries(msg rpcMessage) int {
+	if !safeToResend(msg) {
+		return c.cfg.PostRetries
+	}
+	if retries, ok := msg.retriesHint(); ok {
+		return retries
+	}
+	return c.cfg.PostRetries
+}
+
+// postWithRetry POSTs a message, retrying transport failures and retryable
+// statuses up to retries times, and returns how many retries it used. A
+// message that isn't safe to resend is only retried when it never reached
+// the server.
+func (c *SSEClient) postWithRetry(ctx context.Context, messageURL string, line []byte, msg rpcMessage, sessionID, token string, retries int) (*http.Response, int, error) {
+	delay := c.cfg.PostRetryBase
+	for attempt := 0; ; attempt++ {
+		resp, err := c.postMessage(ctx, messageURL, line, msg, sessionID, token)
+		if attempt >= retries || ctx.Err() != nil || !c.retryFits(ctx, delay) {
+			return resp, attempt, err
+		}
+
+		var failure string
 		if err != nil {
-			log.Printf("Failed to read response: %v", err)
-			c.writeError(-32603, "Failed to read response")
-			continue
+			if isCertificateError(err) || (!safeToResend(msg) && !neverSent(err)) {
+				return resp, attempt, err
+			}
+			failure = c.redactSessionQuery(err.Error())
+		} else if c.isRetryable(resp.StatusCode) && safeToResend(msg) {
+			failure = fmt.Sprintf("HTTP %d", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			return resp, attempt, nil
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("HTTP error %d: %s", resp.StatusCode, string(body))
-			c.writeHTTPError(resp.StatusCode)
-			continue
+		log.Printf("Message POST failed (%s), retrying in %s (retry %d/%d)", failure, delay, attempt+1, retries)
+		c.sleep(ctx, delay)
+		delay = nextPostRetryDelay(delay, c.cfg.PostRetryMultiplier, c.cfg.PostRetryMax)
+	}
+}
+
+// retryFits reports whether a retry after delay would start before the
+// send's deadline. Attempts share that deadline, so one that can't start
+// in time would only end in a timeout, hiding the failure before it.
+func (c *SSEClient) retryFits(ctx context.Context, delay time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || c.clock.Now().Add(delay).Before(deadline)
+}
+
+// nextPostRetryDelay grows a POST retry delay by multiplier, capped at max
+func nextPostRetryDelay(delay time.Duration, multiplier float64, max time.Duration) time.Duration {
+	next := time.Duration(float64(delay) * multiplier)
+	if next > max || next < delay {
+		return max
+	}
+	return next
+}
+
+// postMessage sends a single message POST, authorized with token or, if
+// that is "", the next token from the pool
+func (c *SSEClient) postMessage(ctx context.Context, messageURL string, line []byte, msg rpcMessage, sessionID, token string) (*http.Response, error) {
+	// A bytes.Reader body gives the request a fixed Content-Length, so it
+	// is never sent chunked
+	req, err := http.NewRequestWithContext(ctx, "POST", messageURL, bytes.NewReader(line))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if token == "" {
+		token = c.tokens.pick()
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", c.cfg.ContentType)
+	if c.cfg.DeclareSize {
+		req.Header.Set("X-Arcpoint-Payload-Bytes", strconv.Itoa(len(line)))
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+	for name, value := range c.cfg.MethodHeaders[msg.Method] {
+		req.Header.Set(name, value)
+	}
+	if c.cfg.Transport == transportStreamableHTTP {
+		req.Header.Set("Accept", "application/json, text/event-stream")
+		if sessionID != "" {
+			req.Header.Set(sessionHeader, sessionID)
 		}
+	} else if c.cfg.SessionHeader != "" && sessionID != "" {
+		req.Header.Set(c.cfg.SessionHeader, sessionID)
+	}
+	if trace, ok := traceFromContext(ctx); ok {
+		req.Header.Set("traceparent", trace.parent)
+		if trace.state != "" && validHeaderValue(trace.state) {
+			req.Header.Set("tracestate", trace.state)
+		}
+	}
+
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	resp, err := c.msgClient.Do(req)
+	if err == nil {
+		c.tokens.noteStatus(token, resp.StatusCode)
+	}
+	return resp, err
+}
 
-		// Forward immediate response to stdout
-		fmt.Println(string(body))
+// setInstanceHeader identifies this instance to the server, if configured
+func (c *SSEClient) setInstanceHeader(req *http.Request) {
+	if c.cfg.InstanceHeader && c.cfg.InstanceLabel != "" {
+		req.Header.Set("X-Arcpoint-Instance", c.cfg.InstanceLabel)
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading stdin: %v", err)
+// isRetryable reports whether a message POST that got statusCode should be
+// retried
+func (c *SSEClient) isRetryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
 	}
+	return c.cfg.RetryableStatus[statusCode]
+}
+
+// idempotentMethods are requests that only read server state, so sending
+// one again after its response was lost can't repeat a side effect
+var idempotentMethods = map[string]bool{
+	"ping":                     true,
+	"tools/list":               true,
+	"resources/list":           true,
+	"resources/templates/list": true,
+	"resources/read":           true,
+	"prompts/list":             true,
+	"prompts/get":              true,
+	"completion/complete":      true,
 }
 
-// writeError writes a JSON-RPC error to stdout
-func (c *SSEClient) writeError(code int, message string) {
+// safeToResend reports whether msg may be sent again when its response was
+// cut off. Anything that might change server state, such as tools/call, is
+// never repeated.
+func safeToResend(msg rpcMessage) bool {
+	return msg.isRequest() && idempotentMethods[msg.Method]
+}
+
+// neverSent reports whether a POST failed before any of it could reach the
+// server, so sending it again can't repeat it
+func neverSent(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || isDNSError(err)
+}
+
+// keepalivePost periodically sends a no-op POST so idle pooled connections
+// on the message path aren't closed by intermediaries
+func (c *SSEClient) keepalivePost(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.clock.After(c.cfg.KeepalivePostInterval):
+		}
+		if !c.sendKeepalive(ctx) {
+			return
+		}
+	}
+}
+
+// sendKeepalive sends one keepalive POST, bounded by messageTimeout. It
+// returns false if the request can't be built at all.
+func (c *SSEClient) sendKeepalive(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, messageTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.base()+c.cfg.KeepalivePostPath, nil)
+	if err != nil {
+		log.Printf("Failed to create keepalive request: %v", err)
+		return false
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.tokens.pick())
+	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+
+	resp, err := c.msgClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Keepalive request failed: %v", err)
+		}
+		return true
+	}
+	// Drain the body so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return true
+}
+
+// writeError writes a JSON-RPC error to stdout, echoing id when known
+func (c *SSEClient) writeError(id json.RawMessage, code int, message string) {
 	err := map[string]interface{}{
 		"jsonrpc": "2.0",
 		"error": map[string]interface{}{
@@ -324,12 +1826,17 @@ func (c *SSEClient) writeError(code int, message string) {
 			"message": message,
 		},
 	}
-	data, _ := json.Marshal(err)
-	fmt.Println(string(data))
+	if len(id) > 0 {
+		err["id"] = id
+	}
+	// The id is echoed byte for byte, whatever its JSON type, so the host
+	// can correlate the error with its request
+	data, _ := marshalVerbatim(err)
+	c.out.WriteLine(data)
 }
 
 // writeHTTPError maps HTTP errors to JSON-RPC errors
-func (c *SSEClient) writeHTTPError(statusCode int) {
+func (c *SSEClient) writeHTTPError(id json.RawMessage, statusCode int) {
 	var errorCode int
 	var errorMessage string
 
@@ -351,5 +1858,5 @@ func (c *SSEClient) writeHTTPError(statusCode int) {
 		errorMessage = fmt.Sprintf("Server error: %d", statusCode)
 	}
 
-	c.writeError(errorCode, errorMessage)
+	c.failRequest(id, errorCode, errorMessage)
 }
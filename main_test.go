@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the output writer's goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newTestClient creates a client for baseURL configured from env, with its
+// stdout captured in the returned buffer
+func newTestClient(t *testing.T, baseURL string, env map[string]string) (*SSEClient, *syncBuffer) {
+	t.Helper()
+	return newTestClientWithClock(t, baseURL, env, realClock{})
+}
+
+// newTestClientWithClock is newTestClient with the client's timing taken
+// from clk
+func newTestClientWithClock(t *testing.T, baseURL string, env map[string]string, clk clock) (*SSEClient, *syncBuffer) {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	c := newClientWithClock(baseURL, "test-token", cfg, clk)
+	out := &syncBuffer{}
+	c.out = newOutputWriter(out, cfg.OutputEOL, cfg.SanitizeOutput, cfg.ByteFidelity, clk)
+	c.progress = newProgressCoalescer(cfg.ProgressInterval, c.clock, c.out.WriteLine)
+	c.streams[0].setSessionID("test-session")
+	return c, out
+}
+
+// captureLog redirects the standard logger for the rest of the test
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logs
+}
+
+// send passes line through handleOutbound as if the host had written it
+func send(c *SSEClient, line string) {
+	c.handleOutbound(context.Background(), []byte(line))
+}
+
+// flushOutput closes c's output and returns everything written to stdout
+func flushOutput(t *testing.T, c *SSEClient, out *syncBuffer) string {
+	t.Helper()
+	if err := c.out.Close(time.Second); err != nil {
+		t.Fatalf("flushing output: %v", err)
+	}
+	return out.String()
+}
+
+func TestPostRetryOnlyResendsSafeMessages(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		line  string
+		posts int64
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x"}}`, 1},
+		{`{"jsonrpc":"2.0","method":"notifications/initialized"}`, 1},
+		{`{"jsonrpc":"2.0","id":2,"method":"tools/list"}`, 3},
+	}
+	for _, tt := range tests {
+		posts.Store(0)
+		c, out := newTestClient(t, srv.URL, map[string]string{
+			"ARCPOINT_POST_RETRIES":       "2",
+			"ARCPOINT_POST_RETRY_BASE_MS": "1",
+		})
+		send(c, tt.line)
+		flushOutput(t, c, out)
+		if got := posts.Load(); got != tt.posts {
+			t.Errorf("%s: got %d POSTs, want %d", tt.line, got, tt.posts)
+		}
+	}
+}
+
+func TestPostRetryResendsRefusedConnection(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	logs := captureLog(t)
+	c, out := newTestClient(t, url, map[string]string{
+		"ARCPOINT_POST_RETRIES":       "2",
+		"ARCPOINT_POST_RETRY_BASE_MS": "1",
+	})
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x"}}`)
+	got := flushOutput(t, c, out)
+	if !strings.Contains(got, `"id":1`) || !strings.Contains(got, "Connection error") {
+		t.Errorf("expected a connection error for id 1, got %q", got)
+	}
+	if !strings.Contains(logs.String(), "retry 2/2") {
+		t.Errorf("refused tools/call was not retried:\n%s", logs)
+	}
+}
+
+// cutOffHandler answers 200 with a body that ends before its Content-Length
+func cutOffHandler(posts *atomic.Int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"jsonrpc\":\"2.0\",")
+		buf.Flush()
+	}
+}
+
+func TestCutOffResponseIsNotResentForToolsCall(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(cutOffHandler(&posts))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_POST_RETRIES":       "3",
+		"ARCPOINT_POST_RETRY_BASE_MS": "1",
+	})
+	send(c, `{"jsonrpc":"2.0","id":7,"method":"tools/call","params":{"name":"x"}}`)
+	got := flushOutput(t, c, out)
+	if n := posts.Load(); n != 1 {
+		t.Errorf("tools/call was POSTed %d times, want exactly 1", n)
+	}
+	if !strings.Contains(got, `"code":-32006`) || !strings.Contains(got, `"id":7`) {
+		t.Errorf("expected a -32006 transport error for id 7, got %q", got)
+	}
+}
+
+func TestCutOffResponseIsResentForToolsList(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(cutOffHandler(&posts))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_POST_RETRIES":       "2",
+		"ARCPOINT_POST_RETRY_BASE_MS": "1",
+	})
+	send(c, `{"jsonrpc":"2.0","id":8,"method":"tools/list"}`)
+	flushOutput(t, c, out)
+	if n := posts.Load(); n != 3 {
+		t.Errorf("tools/list was POSTed %d times, want 3", n)
+	}
+}
+
+func TestResendsAndPostRetriesShareOneBudget(t *testing.T) {
+	// Every other POST is refused with 503, and the rest are cut off
+	var posts atomic.Int64
+	cutOff := cutOffHandler(new(atomic.Int64))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if posts.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		cutOff(w, r)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_POST_RETRIES":       "2",
+		"ARCPOINT_POST_RETRY_BASE_MS": "1",
+	})
+	send(c, `{"jsonrpc":"2.0","id":9,"method":"tools/list"}`)
+	flushOutput(t, c, out)
+	if n := posts.Load(); n != 3 {
+		t.Errorf("tools/list was POSTed %d times with 2 retries, want 3", n)
+	}
+}
+
+func TestRetriesHintOnlyAppliesToSafeMessages(t *testing.T) {
+	c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_POST_RETRIES": "1"})
+	defer flushOutput(t, c, out)
+
+	tests := []struct {
+		line string
+		want int
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"tools/list","params":{"_meta":{"maxRetries":4}}}`, 4},
+		{`{"jsonrpc":"2.0","id":2,"method":"tools/list","params":{"_meta":{"maxRetries":99}}}`, maxRetriesHintCap},
+		{`{"jsonrpc":"2.0","id":3,"method":"tools/list"}`, 1},
+		{`{"jsonrpc":"2.0","id":4,"method":"tools/call","params":{"_meta":{"maxRetries":4}}}`, 1},
+	}
+	for _, tt := range tests {
+		if got := c.postRetries(parseMessage([]byte(tt.line))); got != tt.want {
+			t.Errorf("%s: got %d retries, want %d", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestMethodPolicyAppliesToBatchElements(t *testing.T) {
+	var bodies []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_BLOCKED_METHODS": "tools/call"})
+	send(c, `[{"jsonrpc":"2.0","id":1,"method":"tools/call"},{"jsonrpc":"2.0","id":2,"method":"tools/list"}]`)
+	send(c, `[{"jsonrpc":"2.0","id":3,"method":"tools/call"}]`)
+	got := flushOutput(t, c, out)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{`[{"jsonrpc":"2.0","id":2,"method":"tools/list"}]`}; !slices.Equal(bodies, want) {
+		t.Errorf("server received %q, want %q", bodies, want)
+	}
+	for _, id := range []string{`"id":1`, `"id":3`} {
+		if !strings.Contains(got, id) {
+			t.Errorf("no error for blocked request %s in %q", id, got)
+		}
+	}
+}
+
+func TestServerRequestIDsAreUniqueAcrossStreams(t *testing.T) {
+	posted := make(map[string]string)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posted[r.URL.Query().Get("sessionId")] = string(body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_STREAMS": "/a,/b"})
+	c.streams[0].setSessionID("session-a")
+	c.streams[1].setSessionID("session-b")
+
+	for _, s := range c.streams {
+		request := []string{`{"jsonrpc":"2.0","id":1,"method":"sampling/createMessage"}`}
+		if err := c.handleEvent(s, "message", "", request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := flushOutput(t, c, out)
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+		ids = append(ids, string(parseMessage([]byte(line)).ID))
+	}
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Fatalf("server requests reached the host with ids %q, want two distinct ids", ids)
+	}
+
+	// Answer in the opposite order to check each goes back to its stream
+	send(c, `{"jsonrpc":"2.0","id":`+ids[1]+`,"result":{"from":"b"}}`)
+	send(c, `{"jsonrpc":"2.0","id":`+ids[0]+`,"result":{"from":"a"}}`)
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]string{
+		"session-a": `{"jsonrpc":"2.0","id":1,"result":{"from":"a"}}`,
+		"session-b": `{"jsonrpc":"2.0","id":1,"result":{"from":"b"}}`,
+	}
+	if !maps.Equal(posted, want) {
+		t.Errorf("responses posted as %q, want %q", posted, want)
+	}
+}
+
+func TestStreamsRequireSSETransport(t *testing.T) {
+	t.Setenv("ARCPOINT_STREAMS", "/a,/b")
+	t.Setenv("ARCPOINT_TRANSPORT", transportStreamableHTTP)
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted ARCPOINT_STREAMS with streamable-http")
+	}
+}
+
+func TestRequestErrorsRedactSessionID(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	logs := captureLog(t)
+	c, out := newTestClient(t, url, nil)
+	c.streams[0].setSessionID("secret-session-id")
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	got := flushOutput(t, c, out)
+	if !strings.Contains(logs.String(), "sessionId=secr...") {
+		t.Errorf("expected the redacted session id in the log:\n%s", logs)
+	}
+	for name, text := range map[string]string{"log": logs.String(), "stdout": got} {
+		if strings.Contains(text, "secret-session-id") {
+			t.Errorf("%s contains the full session id:\n%s", name, text)
+		}
+	}
+}
+
+func TestRawSSEDumpRedactsSessionID(t *testing.T) {
+	logs := captureLog(t)
+	c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_RAW_SSE": "true"})
+	defer flushOutput(t, c, out)
+	c.handleEvent(c.streams[0], "endpoint", "", []string{"/message?sessionId=secret-session-id"})
+	if strings.Contains(logs.String(), "secret-session-id") {
+		t.Errorf("raw SSE dump contains the full session id:\n%s", logs)
+	}
+}
+
+func TestResponsesOnlyRefusesServerRequests(t *testing.T) {
+	posted := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_RESPONSES_ONLY": "true"})
+	c.forwardMessage([]byte(`[{"jsonrpc":"2.0","id":"s1","method":"sampling/createMessage"},{"jsonrpc":"2.0","method":"notifications/message","params":{}}]`))
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","id":"s2","method":"elicitation/create"}`))
+
+	replies := map[string]bool{}
+	for range 2 {
+		select {
+		case body := <-posted:
+			msg := parseMessage([]byte(body))
+			if !strings.Contains(body, `"code":-32601`) {
+				t.Errorf("server got %s, want a -32601 error", body)
+			}
+			replies[string(msg.ID)] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("server request was never answered")
+		}
+	}
+	if !replies[`"s1"`] || !replies[`"s2"`] {
+		t.Errorf("answered %v, want both server requests", replies)
+	}
+
+	got := flushOutput(t, c, out)
+	if strings.Contains(got, "sampling") || strings.Contains(got, "elicitation") {
+		t.Errorf("server request reached the host: %q", got)
+	}
+	if want := `[{"jsonrpc":"2.0","method":"notifications/message","params":{}}]`; strings.TrimSpace(got) != want {
+		t.Errorf("host got %q, want %q", got, want)
+	}
+}
+
+func TestCloseWaitsForServerRequestRefusals(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		posts.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, _ := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_RESPONSES_ONLY": "true"})
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","id":"s1","method":"sampling/createMessage"}`))
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := posts.Load(); n != 1 {
+		t.Errorf("Close returned with the refusal still in flight (%d posts)", n)
+	}
+}
+
+func TestGzipImmediateResponseIsDecoded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"tools":[]}}`))
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, nil)
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	if got := flushOutput(t, c, out); !strings.Contains(got, `"result":{"tools":[]}`) {
+		t.Errorf("gzipped response was not forwarded decoded, got %q", got)
+	}
+}
+
+func TestGzipHeaderOnEmptyResponseIsIgnored(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(status)
+		}))
+		logs := captureLog(t)
+		c, out := newTestClient(t, srv.URL, nil)
+		send(c, `{"jsonrpc":"2.0","method":"notifications/initialized"}`)
+		got := flushOutput(t, c, out)
+		srv.Close()
+		if got != "" || strings.Contains(logs.String(), "Failed to read response") {
+			t.Errorf("%d: empty gzip response was treated as an error: stdout %q, log:\n%s", status, got, logs)
+		}
+	}
+}
+
+func TestGzipHeaderOnEmptyChunkedResponseIsIgnored(t *testing.T) {
+	for _, status := range []string{"200 OK", "202 Accepted"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 " + status + "\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n")
+			buf.Flush()
+		}))
+		logs := captureLog(t)
+		c, out := newTestClient(t, srv.URL, nil)
+		// Compressed without being asked, so the transport leaves it alone
+		c.msgClient.Transport.(*http.Transport).DisableCompression = true
+		send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+		got := flushOutput(t, c, out)
+		srv.Close()
+		if got != "" || strings.Contains(logs.String(), "Failed to read response") {
+			t.Errorf("%s: empty chunked gzip response was treated as an error: stdout %q, log:\n%s", status, got, logs)
+		}
+	}
+}
+
+func TestPostRetryStopsWhenBackoffPassesDeadline(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, _ := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_POST_RETRIES":       "3",
+		"ARCPOINT_POST_RETRY_BASE_MS": "5000",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	line := []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	started := time.Now()
+	resp, _, err := c.postWithRetry(ctx, srv.URL+"/message", line, parseMessage(line), "test-session", "", 3)
+	if err != nil {
+		t.Fatalf("expected the last response, got error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503", resp.StatusCode)
+	}
+	if got := posts.Load(); got != 1 {
+		t.Errorf("got %d POSTs, want 1", got)
+	}
+	if waited := time.Since(started); waited > 500*time.Millisecond {
+		t.Errorf("waited %s for a retry that couldn't fit", waited)
+	}
+}
+
+func TestMalformedEndpointReconnectsWithoutEndpointTimeout(t *testing.T) {
+	captureLog(t)
+	for _, tt := range []struct {
+		timeout string
+		want    error
+	}{
+		{"", errUnusableEndpoint},
+		{"10s", nil},
+	} {
+		c, _ := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_ENDPOINT_TIMEOUT": tt.timeout})
+		err := c.handleEvent(c.streams[0], "endpoint", "", []string{"http://[::1"})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ENDPOINT_TIMEOUT=%q: got %v, want %v", tt.timeout, err, tt.want)
+		}
+	}
+	if got := reconnectReason(errUnusableEndpoint); got != reasonBadEndpoint {
+		t.Errorf("reconnect reason %q, want %q", got, reasonBadEndpoint)
+	}
+}
+
+func TestBareJSONValuesAreRejected(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	for _, line := range []string{`42`, `-1.5e3`, `null`, `true`, `false`, `"hello"`, ` "padded" `} {
+		c, out := newTestClient(t, srv.URL, nil)
+		send(c, line)
+		got := flushOutput(t, c, out)
+		if !strings.Contains(got, `"code":-32600`) || !strings.Contains(got, `"id":null`) {
+			t.Errorf("%s: expected a -32600 error with a null id, got %q", line, got)
+		}
+	}
+	if got := posts.Load(); got != 0 {
+		t.Errorf("%d bare values were posted to the server", got)
+	}
+}
+
+func TestSSERequestAsksForIdentityEncoding(t *testing.T) {
+	encodings := make(chan []string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Values("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: endpoint\ndata: /message?sessionId=s1\n\n")
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, _ := newTestClient(t, srv.URL, nil)
+	c.connectSSE(context.Background(), c.streams[0])
+	if got := <-encodings; !slices.Equal(got, []string{"identity"}) {
+		t.Errorf("SSE GET sent Accept-Encoding %q, want identity", got)
+	}
+}
+
+func TestMessagePostHasContentLength(t *testing.T) {
+	type request struct {
+		length   int64
+		encoding []string
+		declared string
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- request{r.ContentLength, r.TransferEncoding, r.Header.Get("X-Arcpoint-Payload-Bytes")}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	line := `{"jsonrpc":"2.0","method":"notifications/initialized"}`
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_DECLARE_SIZE": "true"})
+	send(c, line)
+	flushOutput(t, c, out)
+	got := <-requests
+	if got.length != int64(len(line)) {
+		t.Errorf("Content-Length %d, want %d", got.length, len(line))
+	}
+	if len(got.encoding) != 0 {
+		t.Errorf("POST was sent with Transfer-Encoding %q", got.encoding)
+	}
+	if got.declared != strconv.Itoa(len(line)) {
+		t.Errorf("X-Arcpoint-Payload-Bytes %q, want %d", got.declared, len(line))
+	}
+}
+
+func TestHTMLResponseIsReportedAsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html><body>502 Bad Gateway test-token</body></html>")
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, nil)
+	send(c, `{"jsonrpc":"2.0","id":"a","method":"tools/list"}`)
+	got := flushOutput(t, c, out)
+	if !json.Valid([]byte(got)) {
+		t.Fatalf("HTML page was forwarded to the host: %q", got)
+	}
+	if !strings.Contains(got, `"id":"a"`) || !strings.Contains(got, `"code":-32603`) || !strings.Contains(got, "502 Bad Gateway") {
+		t.Errorf("expected a -32603 error quoting the page for id a, got %q", got)
+	}
+	if strings.Contains(got, "test-token") {
+		t.Errorf("API token leaked into the error: %q", got)
+	}
+}
+
+// chunkedHandler writes body in pieces, flushing after each so the response
+// uses chunked transfer encoding with no Content-Length
+func chunkedHandler(body string, piece int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for rest := body; len(rest) > 0; {
+			n := min(piece, len(rest))
+			io.WriteString(w, rest[:n])
+			w.(http.Flusher).Flush()
+			rest = rest[n:]
+		}
+	}
+}
+
+func TestChunkedResponseIsReadUpToCap(t *testing.T) {
+	body := `{"jsonrpc":"2.0","id":1,"result":{"text":"` + strings.Repeat("x", 200) + `"}}`
+	srv := httptest.NewServer(chunkedHandler(body, 16))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_MAX_RESPONSE_BYTES": strconv.Itoa(len(body))})
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	if got := flushOutput(t, c, out); strings.TrimSpace(got) != body {
+		t.Errorf("chunked response at the cap was not forwarded intact, got %q", got)
+	}
+
+	c, out = newTestClient(t, srv.URL, map[string]string{"ARCPOINT_MAX_RESPONSE_BYTES": strconv.Itoa(len(body) - 1)})
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	if got := flushOutput(t, c, out); !strings.Contains(got, "Response too large") {
+		t.Errorf("chunked response over the cap was not refused, got %q", got)
+	}
+}
+
+func TestLargeBase64ContentIsForwardedByteExact(t *testing.T) {
+	blob := make([]byte, 1<<20)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	// Escapes a re-encode would normalise are kept alongside the blob
+	payload := `{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"image","mimeType":"image/png","data":"` +
+		base64.StdEncoding.EncodeToString(blob) + `"},{"type":"text","text":"<b> \/ é"}]}}`
+
+	captureLog(t)
+	c, out := newTestClient(t, "http://127.0.0.1:0", map[string]string{
+		"ARCPOINT_STRICT_OUTPUT":   "true",
+		"ARCPOINT_SANITIZE_OUTPUT": "true",
+	})
+	if err := c.handleEvent(c.streams[0], "message", "", []string{payload}); err != nil {
+		t.Fatal(err)
+	}
+	if got := flushOutput(t, c, out); got != payload+"\n" {
+		t.Errorf("payload changed on the way to stdout (%d bytes in, %d out)", len(payload), len(got)-1)
+	}
+}
+
+func TestPostRetryBackoffUsesItsOwnSettings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	clk := newFakeClock()
+	c, _ := newTestClientWithClock(t, srv.URL, map[string]string{
+		"ARCPOINT_POST_RETRIES":          "4",
+		"ARCPOINT_POST_RETRY_BASE_MS":    "100",
+		"ARCPOINT_POST_RETRY_MAX_MS":     "500",
+		"ARCPOINT_POST_RETRY_MULTIPLIER": "3",
+	}, clk)
+	line := []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, _, err := c.postWithRetry(context.Background(), srv.URL+"/message", line, parseMessage(line), "test-session", "", 4); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	var delays []time.Duration
+	for range 4 {
+		d := <-clk.started
+		delays = append(delays, d)
+		clk.Advance(d)
+	}
+	<-done
+	want := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond}
+	if !slices.Equal(delays, want) {
+		t.Errorf("retry delays %v, want %v", delays, want)
+	}
+}
+
+func TestPostRetryBackoffStopsOnCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	clk := newFakeClock()
+	c, _ := newTestClientWithClock(t, srv.URL, map[string]string{"ARCPOINT_POST_RETRIES": "4"}, clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	line := []byte(`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, _, err := c.postWithRetry(ctx, srv.URL+"/message", line, parseMessage(line), "test-session", "", 3); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-clk.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not end the retry backoff")
+	}
+}
+
+func TestSyntheticErrorsEchoIDVerbatim(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	for _, id := range []string{`"abc"`, `"7"`, `7`, `1.50`, `1e3`, `"\u0041"`, `null`} {
+		c, out := newTestClient(t, srv.URL, nil)
+		send(c, `{"jsonrpc":"2.0","id":`+id+`,"method":"tools/list"}`)
+		if got := flushOutput(t, c, out); !strings.Contains(got, `"id":`+id+`}`) && !strings.Contains(got, `"id":`+id+`,`) {
+			t.Errorf("id %s was not echoed verbatim: %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// clientEnvMeta describes the client platform for servers that opt in to
+// receiving it on initialize
+func clientEnvMeta() map[string]string {
+	meta := map[string]string{
+		"arcpoint/os":   runtime.GOOS,
+		"arcpoint/arch": runtime.GOARCH,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		meta["arcpoint/hostname"] = hostname
+	}
+	return meta
+}
+
+// addParamsMeta sets fields in a request's params._meta, leaving any field
+// the sender already set untouched. The fields are spliced in so every other
+// byte of the message is left as it was.
+func addParamsMeta(data []byte, fields map[string]string) ([]byte, error) {
+	object := bytes.IndexByte(data, '{')
+	start, end, err := fieldSpan(data, "params")
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return insertField(data, object, []byte(`"params":{"_meta":{`+encodeMetaFields(fields, nil)+`}}`)), nil
+	}
+	params := data[start:end]
+	if string(params) == "null" {
+		return replaceField(data, "params", []byte(`{"_meta":{`+encodeMetaFields(fields, nil)+`}}`))
+	}
+	if params[0] != '{' {
+		return nil, errors.New("params is not an object")
+	}
+
+	metaStart, metaEnd, err := fieldSpan(params, "_meta")
+	if err != nil {
+		return nil, err
+	}
+	if metaStart < 0 {
+		return insertField(data, start, []byte(`"_meta":{`+encodeMetaFields(fields, nil)+`}`)), nil
+	}
+	meta := params[metaStart:metaEnd]
+	if string(meta) == "null" {
+		updated, err := replaceField(params, "_meta", []byte(`{`+encodeMetaFields(fields, nil)+`}`))
+		if err != nil {
+			return nil, err
+		}
+		return replaceField(data, "params", updated)
+	}
+	if meta[0] != '{' {
+		return nil, errors.New("params._meta is not an object")
+	}
+	missing := encodeMetaFields(fields, meta)
+	if missing == "" {
+		return data, nil
+	}
+	return insertField(data, start+metaStart, []byte(missing)), nil
+}
+
+// encodeMetaFields encodes the fields not already in the existing _meta
+// object as comma-separated JSON members, in key order
+func encodeMetaFields(fields map[string]string, existing []byte) string {
+	var members []string
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		if existing != nil {
+			if at, _, err := fieldSpan(existing, key); err != nil || at >= 0 {
+				continue
+			}
+		}
+		name, _ := json.Marshal(key)
+		value, _ := json.Marshal(fields[key])
+		members = append(members, string(name)+":"+string(value))
+	}
+	return strings.Join(members, ",")
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestAddParamsMetaSplicesFields(t *testing.T) {
+	fields := map[string]string{"arcpoint/os": "linux", "arcpoint/arch": "amd64"}
+	tests := []struct {
+		in, want string
+	}{
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"initialize"}`,
+			`{"params":{"_meta":{"arcpoint/arch":"amd64","arcpoint/os":"linux"}},"jsonrpc":"2.0","id":1,"method":"initialize"}`,
+		},
+		{
+			`{"jsonrpc":"2.0","id":1,"method":"initialize","params":null}`,
+			`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"_meta":{"arcpoint/arch":"amd64","arcpoint/os":"linux"}}}`,
+		},
+		{
+			// Spacing, key order and escapes elsewhere are kept as sent
+			`{"id":1, "method":"initialize", "params":{"clientInfo":{"name":"a<b"},  "protocolVersion":"2025-06-18"}}`,
+			`{"id":1, "method":"initialize", "params":{"_meta":{"arcpoint/arch":"amd64","arcpoint/os":"linux"},"clientInfo":{"name":"a<b"},  "protocolVersion":"2025-06-18"}}`,
+		},
+		{
+			`{"id":1,"method":"initialize","params":{"_meta":{"arcpoint/os":"custom"}}}`,
+			`{"id":1,"method":"initialize","params":{"_meta":{"arcpoint/arch":"amd64","arcpoint/os":"custom"}}}`,
+		},
+		{
+			`{"id":1,"method":"initialize","params":{"_meta":{"arcpoint/os":"x","arcpoint/arch":"y"}}}`,
+			`{"id":1,"method":"initialize","params":{"_meta":{"arcpoint/os":"x","arcpoint/arch":"y"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := addParamsMeta([]byte(tt.in), fields)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("addParamsMeta(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := addParamsMeta([]byte(`{"id":1,"params":[1]}`), fields); err == nil {
+		t.Error("accepted positional params")
+	}
+}
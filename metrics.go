@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons a reconnect can happen, logged and counted separately since each
+// is tuned differently
+const (
+	reasonIdleTimeout     = "idle-timeout"
+	reasonEndpointTimeout = "endpoint-timeout"
+	reasonBadEndpoint     = "malformed-endpoint"
+	reasonMaxAge          = "max-age"
+	reasonVersionChange   = "version-change"
+	reasonChaos           = "chaos"
+	reasonBackendSwitch   = "backend-switch"
+	reasonDNSError        = "dns-error"
+	reasonStreamError     = "stream-error"
+	reasonCleanClose      = "clean-close"
+)
+
+var (
+	// errIdleTimeout cancels a connection that saw no activity in time
+	errIdleTimeout = errors.New("no activity on SSE stream")
+	// errEndpointTimeout cancels a connection that never sent its endpoint
+	errEndpointTimeout = errors.New("no endpoint event received")
+	// errNotEventStream means the SSE path answered with something else,
+	// usually because ARCPOINT_API_URL points at the wrong service
+	errNotEventStream = errors.New("endpoint did not return an SSE stream")
+	// errMaxAge cancels a connection that reached ARCPOINT_MAX_CONNECTION_AGE
+	errMaxAge = errors.New("SSE stream reached its maximum age")
+	// errChaosReconnect cancels a connection on purpose when
+	// ARCPOINT_CHAOS_RECONNECT_INTERVAL is set
+	errChaosReconnect = errors.New("chaos testing forced a reconnect")
+	// errMalformedEndpoint ends the client when ARCPOINT_STRICT_ENDPOINT is
+	// set and an endpoint event has neither a session id nor a usable URL
+	errMalformedEndpoint = errors.New("malformed endpoint event")
+	// errUnusableEndpoint reconnects a stream whose endpoint event was
+	// malformed when no endpoint timeout would otherwise end the wait
+	errUnusableEndpoint = errors.New("endpoint event had no usable session")
+	// errBackendSwitch cancels connections when the client fails over to
+	// ARCPOINT_API_URL_FALLBACK or back
+	errBackendSwitch = errors.New("switching backend")
+)
+
+// reconnectReason classifies the result of connectSSE
+func reconnectReason(err error) string {
+	switch {
+	case err == nil:
+		return reasonCleanClose
+	case errors.Is(err, errIdleTimeout):
+		return reasonIdleTimeout
+	case errors.Is(err, errEndpointTimeout):
+		return reasonEndpointTimeout
+	case errors.Is(err, errUnusableEndpoint):
+		return reasonBadEndpoint
+	case errors.Is(err, errMaxAge):
+		return reasonMaxAge
+	case errors.Is(err, errChaosReconnect):
+		return reasonChaos
+	case errors.Is(err, errBackendSwitch):
+		return reasonBackendSwitch
+	case errors.Is(err, errVersionChanged):
+		return reasonVersionChange
+	case isDNSError(err):
+		return reasonDNSError
+	default:
+		return reasonStreamError
+	}
+}
+
+// isDNSError reports whether err is a failure to resolve the server's host
+func isDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// metrics holds counters describing the client's connection history
+type metrics struct {
+	mu            sync.Mutex
+	clock         clock
+	started       time.Time
+	attempts      int64
+	lastConnected time.Time
+	reconnects    map[string]int64
+	// malformedEndpoints counts endpoint events that couldn't be used
+	malformedEndpoints int64
+}
+
+// newMetrics creates an empty set of counters
+func newMetrics(clk clock) *metrics {
+	return &metrics{
+		clock:      clk,
+		started:    clk.Now(),
+		reconnects: make(map[string]int64),
+	}
+}
+
+// recordAttempt counts a connection attempt and returns its number
+func (m *metrics) recordAttempt() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts++
+	return m.attempts
+}
+
+// recordConnected notes that a connection was just established
+func (m *metrics) recordConnected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastConnected = m.clock.Now()
+}
+
+// recordMalformedEndpoint counts an unusable endpoint event
+func (m *metrics) recordMalformedEndpoint() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.malformedEndpoints++
+}
+
+// recordReconnect counts a reconnect for the given reason
+func (m *metrics) recordReconnect(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects[reason]++
+}
+
+// totalReconnects returns the number of reconnects for any reason
+func (m *metrics) totalReconnects() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for _, count := range m.reconnects {
+		total += count
+	}
+	return total
+}
+
+// attemptSummary describes timing for a connection attempt log line
+func (m *metrics) attemptSummary(attempt int64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	last := "never connected"
+	if !m.lastConnected.IsZero() {
+		last = fmt.Sprintf("last connected %s ago", now.Sub(m.lastConnected).Round(time.Second))
+	}
+	return fmt.Sprintf("attempt %d, %s since start, %s", attempt, now.Sub(m.started).Round(time.Second), last)
+}
+
+// status returns the counters in the form written to the status file
+func (m *metrics) status() clientStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := clientStatus{
+		Started:            m.started,
+		Attempts:           m.attempts,
+		Reconnects:         make(map[string]int64, len(m.reconnects)),
+		MalformedEndpoints: m.malformedEndpoints,
+	}
+	if !m.lastConnected.IsZero() {
+		lastConnected := m.lastConnected
+		status.LastConnected = &lastConnected
+	}
+	for reason, count := range m.reconnects {
+		status.Reconnects[reason] = count
+	}
+	return status
+}
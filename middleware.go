@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// messageMiddleware inspects or transforms JSON-RPC messages passing
+// through the client. OnOutbound sees each message read from stdin before it is sent to
+// the server; OnInbound sees each message from the server before it is
+// written to stdout. Returning an error stops the message and reports a
+// JSON-RPC error to the host instead.
+type messageMiddleware interface {
+	OnOutbound([]byte) ([]byte, error)
+	OnInbound([]byte) ([]byte, error)
+}
+
+// use appends middleware to the client's chain. Outbound messages pass
+// through the chain in registration order and inbound messages in reverse,
+// so the first middleware registered is the outermost. use must be called
+// before Run.
+func (c *SSEClient) use(mw ...messageMiddleware) {
+	c.middleware = append(c.middleware, mw...)
+}
+
+// applyOutbound runs a message from the host through the middleware chain
+func (c *SSEClient) applyOutbound(msg []byte) ([]byte, error) {
+	var err error
+	for _, mw := range c.middleware {
+		if msg, err = mw.OnOutbound(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// applyInbound runs a message from the server through the middleware chain
+func (c *SSEClient) applyInbound(msg []byte) ([]byte, error) {
+	var err error
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		if msg, err = c.middleware[i].OnInbound(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// correlationKey is the context key for a message's correlation id
+type correlationKey struct{}
+
+// correlationID returns the correlation id attached to a message's context,
+// tying together its debug logs and POST
+func correlationID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationKey{}).(string)
+	return id, ok
+}
+
+// withCorrelationID attaches a fresh correlation id to ctx
+func withCorrelationID(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return context.WithValue(ctx, correlationKey{}, hex.EncodeToString(b))
+}
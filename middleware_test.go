@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tagMiddleware appends its tag to each message's "via" string, or fails
+type tagMiddleware struct {
+	tag string
+	err error
+}
+
+func (m tagMiddleware) tagged(msg []byte) ([]byte, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return bytes.Replace(msg, []byte(`"via":"`), []byte(`"via":"`+m.tag), 1), nil
+}
+
+func (m tagMiddleware) OnOutbound(msg []byte) ([]byte, error) { return m.tagged(msg) }
+func (m tagMiddleware) OnInbound(msg []byte) ([]byte, error)  { return m.tagged(msg) }
+
+func TestMiddlewareRunsInChainOrder(t *testing.T) {
+	posted := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, nil)
+	c.use(tagMiddleware{tag: "a"}, tagMiddleware{tag: "b"})
+	send(c, `{"jsonrpc":"2.0","method":"notifications/x","params":{"via":""}}`)
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","method":"notifications/y","params":{"via":""}}`))
+
+	// Each middleware prepends its tag, so the last to run comes first
+	if got := <-posted; !strings.Contains(got, `"via":"ba"`) {
+		t.Errorf("outbound should run a then b, posted %s", got)
+	}
+	if got := flushOutput(t, c, out); !strings.Contains(got, `"via":"ab"`) {
+		t.Errorf("inbound should run b then a, got %s", got)
+	}
+}
+
+func TestMiddlewareErrorIsReportedToHost(t *testing.T) {
+	captureLog(t)
+	c, out := newTestClient(t, "http://127.0.0.1:0", nil)
+	c.use(tagMiddleware{err: errors.New("refused")})
+	send(c, `{"jsonrpc":"2.0","id":4,"method":"tools/list"}`)
+	got := flushOutput(t, c, out)
+	if !strings.Contains(got, `"id":4`) || !strings.Contains(got, "Middleware error: refused") {
+		t.Errorf("expected a middleware error for id 4, got %q", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// defaultProtocolVersion is reported by the offline initialize result when
+// neither the host nor ARCPOINT_PROTOCOL_VERSION names a version
+const defaultProtocolVersion = "2024-11-05"
+
+// noteInitialize remembers the protocolVersion from the host's first
+// initialize, so anything the client constructs later uses the exact
+// version the host asked for
+func (c *SSEClient) noteInitialize(msg rpcMessage) {
+	version := requestedProtocolVersion(msg)
+	if version == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocolVersion == "" {
+		c.protocolVersion = version
+	}
+}
+
+// requestedProtocolVersion returns the protocolVersion in an initialize
+// request's params, or ""
+func requestedProtocolVersion(msg rpcMessage) string {
+	var params struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	if len(msg.Params) == 0 || json.Unmarshal(msg.Params, &params) != nil {
+		return ""
+	}
+	return params.ProtocolVersion
+}
+
+// syntheticProtocolVersion picks the version for a locally built initialize
+// result. The host's request always wins so the client never downgrades
+// or alters it.
+func (c *SSEClient) syntheticProtocolVersion(msg rpcMessage) string {
+	if version := requestedProtocolVersion(msg); version != "" {
+		return version
+	}
+	c.mu.RLock()
+	version := c.protocolVersion
+	c.mu.RUnlock()
+	if version != "" {
+		return version
+	}
+	return c.cfg.ProtocolVersion
+}
+
+// writeOfflineInitialize answers an initialize request locally with an
+// empty set of capabilities, so the host can finish its handshake while
+// the backend is unreachable
+func (c *SSEClient) writeOfflineInitialize(msg rpcMessage) {
+	resp := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      msg.ID,
+		"result": map[string]interface{}{
+			"protocolVersion": c.syntheticProtocolVersion(msg),
+			"capabilities":    map[string]interface{}{},
+			"serverInfo": map[string]string{
+				"name":    "arcpoint-offline",
+				"version": version,
+			},
+			"instructions": "The Arcpoint backend is unreachable, so no tools are available.",
+		},
+	}
+	data, err := marshalVerbatim(resp)
+	if err != nil {
+		log.Printf("Failed to build offline initialize result: %v", err)
+		return
+	}
+	log.Println("Backend unreachable, answering initialize with an offline result")
+	c.pending.complete(msg.ID)
+	c.out.WriteLine(data)
+}
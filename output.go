@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputWriter serialises JSON-RPC frames onto stdout from a single
+// goroutine so concurrent producers can't interleave partial lines
+type outputWriter struct {
+	w     *bufio.Writer
+	eol   string
+	clock clock
+	// sanitize strips a BOM or whitespace from the start of frames
+	sanitize bool
+	// exact keeps a frame's own trailing line terminator, ending the line
+	// with it instead of eol
+	exact bool
+	lines chan []byte
+	done  chan struct{}
+	// closing is closed when Close starts, releasing writers blocked on a
+	// full queue so they can't hold up Close
+	closing   chan struct{}
+	closeOnce sync.Once
+	mu        sync.RWMutex
+	closed    bool
+	// tap, if set, sees every frame as it is queued
+	tap func(line []byte)
+	// frames counts frames queued, to tell when stdout has been idle
+	frames atomic.Int64
+}
+
+// newOutputWriter creates an output writer that ends each frame with eol
+// and starts its write loop
+func newOutputWriter(w io.Writer, eol string, sanitize, exact bool, clk clock) *outputWriter {
+	o := &outputWriter{
+		w:        bufio.NewWriter(w),
+		eol:      eol,
+		clock:    clk,
+		sanitize: sanitize,
+		exact:    exact,
+		lines:    make(chan []byte, 256),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// run writes queued lines, flushing whenever the queue is empty
+func (o *outputWriter) run() {
+	defer close(o.done)
+	for line := range o.lines {
+		// Frames that already end in a newline would otherwise be
+		// followed by an empty line, so the terminator is trimmed, or kept
+		// in place of eol when the bytes must reach the host unchanged
+		switch {
+		case !o.exact:
+			o.w.Write(bytes.TrimRight(line, "\r\n"))
+			o.w.WriteString(o.eol)
+		case bytes.HasSuffix(line, []byte("\n")):
+			o.w.Write(line)
+		default:
+			o.w.Write(line)
+			o.w.WriteString(o.eol)
+		}
+		if len(o.lines) == 0 {
+			o.w.Flush()
+		}
+	}
+	o.w.Flush()
+}
+
+// WriteLine queues a single frame for stdout. Frames written after Close,
+// or still waiting for room in the queue when Close is called, are dropped.
+func (o *outputWriter) WriteLine(line []byte) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return
+	}
+	if o.sanitize {
+		line = sanitizeFrame(line)
+	}
+	if o.tap != nil {
+		o.tap(line)
+	}
+	o.frames.Add(1)
+	line = append([]byte(nil), line...)
+	select {
+	case o.lines <- line:
+		return
+	default:
+	}
+	select {
+	case o.lines <- line:
+	case <-o.closing:
+	}
+}
+
+// utf8BOM is the byte order mark some servers put before a JSON body
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// sanitizeFrame strips any BOM or whitespace before the opening { or [ of a
+// frame, logging when that changed anything. Frames that don't open with
+// either are left alone.
+func sanitizeFrame(line []byte) []byte {
+	trimmed := line
+	for {
+		next := bytes.TrimLeft(bytes.TrimPrefix(trimmed, utf8BOM), " \t\r\n")
+		if len(next) == len(trimmed) {
+			break
+		}
+		trimmed = next
+	}
+	if len(trimmed) == len(line) || len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return line
+	}
+	log.Printf("Sanitized output frame: stripped %q before the JSON", line[:len(line)-len(trimmed)])
+	return trimmed
+}
+
+// Close stops accepting frames and waits up to timeout for queued frames
+// to be flushed
+func (o *outputWriter) Close(timeout time.Duration) error {
+	o.closeOnce.Do(func() { close(o.closing) })
+	o.mu.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.lines)
+	}
+	o.mu.Unlock()
+
+	select {
+	case <-o.done:
+		return nil
+	case <-o.clock.After(timeout):
+		return errors.New("timed out flushing output")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingWriter is an io.Writer whose writes wait until it is closed
+type blockingWriter chan struct{}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w
+	return len(p), nil
+}
+
+func TestCloseDoesNotDeadlockOnFullQueue(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	o := newOutputWriter(blockingWriter(blocked), "\n", false, false, realClock{})
+
+	// Fill the queue so further writers block on it
+	for range cap(o.lines) + 2 {
+		go o.WriteLine([]byte(`{"jsonrpc":"2.0","method":"x"}`))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- o.Close(100 * time.Millisecond) }()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("Close reported a flush that can't have happened")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close deadlocked behind a writer blocked on the full queue")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// rpcMessage holds the JSON-RPC fields the client inspects. The id is kept
+// raw so it can be echoed back exactly as the sender wrote it.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// parseMessage decodes the envelope of a JSON-RPC message. Anything that
+// isn't a JSON object yields the zero message.
+func parseMessage(data []byte) rpcMessage {
+	var msg rpcMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return rpcMessage{}
+	}
+	return msg
+}
+
+// isRequest reports whether the message is a request expecting a response
+func (m rpcMessage) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+// isResponse reports whether the message is a response to a request
+func (m rpcMessage) isResponse() bool {
+	return m.Method == "" && len(m.ID) > 0
+}
+
+// splitBatch returns the messages of a JSON-RPC batch, or false if data
+// isn't one
+func splitBatch(data []byte) ([]json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, false
+	}
+	var batch []json.RawMessage
+	if json.Unmarshal(trimmed, &batch) != nil {
+		return nil, false
+	}
+	return batch, true
+}
+
+// joinBatch encodes messages as a batch, each kept byte for byte
+func joinBatch(messages [][]byte) []byte {
+	out := []byte("[")
+	for i, msg := range messages {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = append(out, msg...)
+	}
+	return append(out, ']')
+}
+
+// isJSONRPCFrame reports whether data is a JSON-RPC 2.0 message, or a
+// non-empty batch of them
+func isJSONRPCFrame(data []byte) bool {
+	var batch []json.RawMessage
+	if json.Unmarshal(data, &batch) == nil {
+		if len(batch) == 0 {
+			return false
+		}
+		for _, item := range batch {
+			if !isJSONRPCFrame(item) || bytes.HasPrefix(bytes.TrimSpace(item), []byte("[")) {
+				return false
+			}
+		}
+		return true
+	}
+	var msg struct {
+		JSONRPC *string `json:"jsonrpc"`
+	}
+	if json.Unmarshal(data, &msg) != nil || msg.JSONRPC == nil {
+		return false
+	}
+	return *msg.JSONRPC == "2.0"
+}
+
+// requestMeta is the subset of params._meta the client understands
+type requestMeta struct {
+	Meta struct {
+		TimeoutMs   *int64 `json:"timeoutMs"`
+		MaxRetries  *int   `json:"maxRetries"`
+		Stream      string `json:"arcpoint/stream"`
+		Traceparent string `json:"traceparent"`
+		Tracestate  string `json:"tracestate"`
+	} `json:"_meta"`
+}
+
+// timeoutHint returns the timeout a request asks for in params._meta, or 0
+func (m rpcMessage) timeoutHint() time.Duration {
+	var meta requestMeta
+	if len(m.Params) == 0 || json.Unmarshal(m.Params, &meta) != nil {
+		return 0
+	}
+	if ms := meta.Meta.TimeoutMs; ms != nil && *ms > 0 {
+		return time.Duration(*ms) * time.Millisecond
+	}
+	return 0
+}
+
+// maxRetriesHintCap bounds params._meta.maxRetries so one request can't
+// keep retrying indefinitely
+const maxRetriesHintCap = 10
+
+// retriesHint returns the POST retry count a message asks for in
+// params._meta.maxRetries, capped at maxRetriesHintCap. ok is false when
+// the message has no valid hint.
+func (m rpcMessage) retriesHint() (retries int, ok bool) {
+	var meta requestMeta
+	if len(m.Params) == 0 || json.Unmarshal(m.Params, &meta) != nil {
+		return 0, false
+	}
+	if n := meta.Meta.MaxRetries; n != nil && *n >= 0 {
+		return min(*n, maxRetriesHintCap), true
+	}
+	return 0, false
+}
+
+// streamHint returns the SSE stream path a request asks to be sent on in
+// params._meta, or ""
+func (m rpcMessage) streamHint() string {
+	var meta requestMeta
+	if len(m.Params) == 0 || json.Unmarshal(m.Params, &meta) != nil {
+		return ""
+	}
+	return meta.Meta.Stream
+}
+
+// traceHint returns the W3C trace context carried in params._meta, if any
+func (m rpcMessage) traceHint() (traceparent, tracestate string) {
+	var meta requestMeta
+	if len(m.Params) == 0 || json.Unmarshal(m.Params, &meta) != nil {
+		return "", ""
+	}
+	return meta.Meta.Traceparent, meta.Meta.Tracestate
+}
+
+// pendingRequest is an outbound request still waiting for its response
+type pendingRequest struct {
+	method  string
+	started time.Time
+	timer   clockTimer
+}
+
+// pendingPruneInterval is how often answered and timed out requests past
+// the grace window are forgotten
+const pendingPruneInterval = 30 * time.Second
+
+// eofWaitTrackLimit is how long a request tracked only for the stdin EOF
+// wait is kept, so one the server never answers isn't held forever
+const eofWaitTrackLimit = time.Hour
+
+// pendingRequests tracks outbound requests by id until they are answered.
+// Requests that time out are remembered for a grace window so a response
+// arriving afterwards can be recognised as late, and answered requests are
+// remembered likewise so a second response can be recognised as a duplicate.
+type pendingRequests struct {
+	mu        sync.Mutex
+	requests  map[string]*pendingRequest
+	window    time.Duration
+	timedOut  map[string]time.Time
+	completed map[string]time.Time
+	clock     clock
+	// pruner is armed while there are remembered requests to forget
+	pruner clockTimer
+}
+
+// newPendingRequests creates an empty request tracker that remembers timed
+// out requests for window
+func newPendingRequests(window time.Duration, clk clock) *pendingRequests {
+	return &pendingRequests{
+		requests:  make(map[string]*pendingRequest),
+		window:    window,
+		timedOut:  make(map[string]time.Time),
+		completed: make(map[string]time.Time),
+		clock:     clk,
+	}
+}
+
+// add starts tracking a request. If timeout is positive, onTimeout runs when
+// no response has arrived in time, or with a nil onTimeout the request is
+// quietly forgotten.
+func (p *pendingRequests) add(id json.RawMessage, method string, timeout time.Duration, onTimeout func()) {
+	key := string(id)
+	req := &pendingRequest{method: method, started: p.clock.Now()}
+	if timeout > 0 {
+		req.timer = p.clock.AfterFunc(timeout, func() {
+			if p.expire(key, req, onTimeout != nil) && onTimeout != nil {
+				onTimeout()
+			}
+		})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old := p.requests[key]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	p.requests[key] = req
+}
+
+// complete stops tracking a request, returning it if it was pending
+func (p *pendingRequests) complete(id json.RawMessage) *pendingRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := string(id)
+	req := p.requests[key]
+	if req == nil {
+		return nil
+	}
+	delete(p.requests, key)
+	if req.timer != nil {
+		req.timer.Stop()
+	}
+
+	if p.window > 0 {
+		p.completed[key] = p.clock.Now()
+		p.schedulePrune()
+	}
+	return req
+}
+
+// expire stops tracking req if it is still the entry for key, remembering
+// it as timed out when late is set
+func (p *pendingRequests) expire(key string, req *pendingRequest, late bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.requests[key] != req {
+		return false
+	}
+	delete(p.requests, key)
+	if late && p.window > 0 {
+		p.timedOut[key] = p.clock.Now()
+		p.schedulePrune()
+	}
+	return true
+}
+
+// schedulePrune arms the pruner if it isn't already. p.mu must be held.
+func (p *pendingRequests) schedulePrune() {
+	if p.pruner == nil {
+		p.pruner = p.clock.AfterFunc(pendingPruneInterval, p.prune)
+	}
+}
+
+// prune forgets answered and timed out requests older than the grace
+// window, re-arming itself while any remain
+func (p *pendingRequests) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruner = nil
+	now := p.clock.Now()
+	for _, remembered := range []map[string]time.Time{p.completed, p.timedOut} {
+		for k, at := range remembered {
+			if now.Sub(at) > p.window {
+				delete(remembered, k)
+			}
+		}
+	}
+	if len(p.completed) > 0 || len(p.timedOut) > 0 {
+		p.schedulePrune()
+	}
+}
+
+// count returns the number of requests still awaiting a response
+func (p *pendingRequests) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.requests)
+}
+
+// isLate reports whether id timed out within the grace window, consuming
+// the entry so only the first late response is matched
+func (p *pendingRequests) isLate(id json.RawMessage) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := string(id)
+	at, ok := p.timedOut[key]
+	if !ok {
+		return false
+	}
+	delete(p.timedOut, key)
+	return p.clock.Now().Sub(at) <= p.window
+}
+
+// isDuplicate reports whether id belongs to a request answered within the
+// grace window, so a response for it is a second one
+func (p *pendingRequests) isDuplicate(id json.RawMessage) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.completed[string(id)]
+	return ok && p.clock.Now().Sub(at) <= p.window
+}
+
+// tracksRequests reports whether responses are checked against the requests
+// they answer, for timeouts, timing or filtering
+func (c *SSEClient) tracksRequests() bool {
+	return c.cfg.ResponseTimeout > 0 || c.cfg.InitializeTimeout > 0 || c.cfg.HonorRequestTimeout || c.cfg.ResponsesOnly || c.cfg.AnnotateTiming
+}
+
+// sendTimeout bounds the POST for msg, including retries and reading an
+// immediate or streamed response. A honored timeout hint longer than
+// messageTimeout extends it, so the hint isn't cut short when the response
+// comes back on the POST itself.
+func (c *SSEClient) sendTimeout(msg rpcMessage) time.Duration {
+	if c.cfg.HonorRequestTimeout && msg.isRequest() {
+		if hint := msg.timeoutHint(); hint > messageTimeout {
+			return hint
+		}
+	}
+	return messageTimeout
+}
+
+// tracksForEOF reports whether requests are tracked so that shutdown on
+// stdin EOF can wait for their responses
+func (c *SSEClient) tracksForEOF() bool {
+	return !c.cfg.SkipEOFWait
+}
+
+// trackRequest records an outbound request, arming its response timer.
+// A request tracked only for the stdin EOF wait is dropped after
+// eofWaitTrackLimit instead of timing out.
+func (c *SSEClient) trackRequest(msg rpcMessage) {
+	if !c.tracksRequests() {
+		c.pending.add(msg.ID, msg.Method, eofWaitTrackLimit, nil)
+		return
+	}
+	timeout := c.cfg.ResponseTimeout
+	initialize := msg.Method == "initialize" && c.cfg.InitializeTimeout > 0
+	if initialize {
+		timeout = c.cfg.InitializeTimeout
+	}
+	if c.cfg.HonorRequestTimeout {
+		if hint := msg.timeoutHint(); hint > 0 {
+			timeout = hint
+		}
+	}
+
+	id := msg.ID
+	c.pending.add(id, msg.Method, timeout, func() {
+		log.Printf("Request %s (%s) timed out after %s", id, msg.Method, timeout)
+		c.ids.forget(id)
+		if initialize {
+			c.writeError(id, -32005, fmt.Sprintf("Initialize timed out after %s: the server did not complete the handshake", timeout))
+			return
+		}
+		c.writeError(id, -32005, fmt.Sprintf("Request timed out after %s", timeout))
+	})
+}
+
+// failRequest reports a locally generated error for a request, so it is no
+// longer considered pending and any response the server still sends under
+// a rewritten id is dropped
+func (c *SSEClient) failRequest(id json.RawMessage, code int, message string) {
+	if len(id) > 0 {
+		c.pending.complete(id)
+		c.ids.forget(id)
+	}
+	c.writeError(id, code, message)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHintExtendsSend(t *testing.T) {
+	long := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"_meta":{"timeoutMs":120000}}}`
+	short := `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"_meta":{"timeoutMs":5000}}}`
+	tests := []struct {
+		honor string
+		line  string
+		want  time.Duration
+	}{
+		{"true", long, 2 * time.Minute},
+		{"true", short, messageTimeout},
+		{"false", long, messageTimeout},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_HONOR_REQUEST_TIMEOUT": tt.honor})
+		if got := c.sendTimeout(parseMessage([]byte(tt.line))); got != tt.want {
+			t.Errorf("honor=%s %s: send timeout %s, want %s", tt.honor, tt.line, got, tt.want)
+		}
+	}
+	if c, _ := newTestClient(t, "http://127.0.0.1:0", nil); c.msgClient.Timeout != 0 {
+		t.Errorf("message client timeout %s would cut a hinted send short", c.msgClient.Timeout)
+	}
+}
+
+func TestPendingRequestsArePrunedOnATimer(t *testing.T) {
+	clk := newFakeClock()
+	p := newPendingRequests(time.Minute, clk)
+
+	// Tracked only for the stdin EOF wait, and never answered
+	p.add(json.RawMessage(`1`), "tools/call", eofWaitTrackLimit, nil)
+	clk.Advance(eofWaitTrackLimit)
+	if n := p.count(); n != 0 {
+		t.Errorf("%d unanswered requests still tracked after %s", n, eofWaitTrackLimit)
+	}
+	if p.isLate(json.RawMessage(`1`)) {
+		t.Error("a request dropped from the EOF wait was remembered as timed out")
+	}
+
+	p.add(json.RawMessage(`2`), "tools/list", 0, nil)
+	p.complete(json.RawMessage(`2`))
+	if !p.isDuplicate(json.RawMessage(`2`)) {
+		t.Fatal("answered request was not remembered")
+	}
+	for range 3 {
+		clk.Advance(pendingPruneInterval)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.completed) != 0 || p.pruner != nil {
+		t.Errorf("answered request still remembered after the window: %v", p.completed)
+	}
+}
+
+func TestSkipEOFWaitStopsUntimedTracking(t *testing.T) {
+	c, _ := newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_SKIP_EOF_WAIT": "true"})
+	if c.tracksRequests() || c.tracksForEOF() {
+		t.Error("requests are tracked with nothing waiting on them")
+	}
+	c, _ = newTestClient(t, "http://127.0.0.1:0", map[string]string{"ARCPOINT_SKIP_EOF_WAIT": "false"})
+	if !c.tracksForEOF() {
+		t.Error("requests are not tracked for the stdin EOF wait")
+	}
+}
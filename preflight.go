@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// preflightTimeout bounds the pre-flight health check
+const preflightTimeout = 10 * time.Second
+
+// preflight makes a quick authenticated GET to the health path so that bad
+// credentials or an unreachable server are reported before the long-lived
+// stream is opened
+func (c *SSEClient) preflight(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base()+c.cfg.PreflightPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create preflight request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.tokens.pick())
+	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+
+	started := c.clock.Now()
+	resp, err := c.msgClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("preflight check failed: %w", err)
+	}
+	// Only the status matters, and a body may never end if the path
+	// turns out to stream
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("preflight check failed with status %d: check ARCPOINT_API_TOKEN", resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("preflight check failed with status %d", resp.StatusCode)
+	}
+	log.Printf("Preflight check passed (%d in %s)", resp.StatusCode, c.clock.Now().Sub(started).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// defaultProgressInterval is the shortest gap between forwarded updates for
+// one progress token when coalescing
+const defaultProgressInterval = 500 * time.Millisecond
+
+// progressTokenIdle is how long a token with nothing held is remembered
+const progressTokenIdle = time.Minute
+
+// progressCoalescer limits notifications/progress to one per interval for
+// each progress token. The latest update held back in an interval is
+// forwarded when the interval ends, and the final update always goes
+// straight through.
+type progressCoalescer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	clock    clock
+	write    func([]byte)
+	tokens   map[string]*progressToken
+	// requests maps the id of each host request that asked for progress
+	// to its progress token
+	requests map[string]string
+}
+
+// progressToken tracks coalescing for one progress token
+type progressToken struct {
+	lastSent time.Time
+	// held is the newest update not yet forwarded, and flush forwards it
+	// at the end of the interval
+	held  []byte
+	flush clockTimer
+}
+
+// newProgressCoalescer creates a coalescer that forwards through write
+func newProgressCoalescer(interval time.Duration, clk clock, write func([]byte)) *progressCoalescer {
+	return &progressCoalescer{
+		interval: interval,
+		clock:    clk,
+		write:    write,
+		tokens:   make(map[string]*progressToken),
+		requests: make(map[string]string),
+	}
+}
+
+// progressParams holds the notifications/progress fields used to coalesce
+type progressParams struct {
+	ProgressToken json.RawMessage `json:"progressToken"`
+	Progress      float64         `json:"progress"`
+	Total         *float64        `json:"total"`
+}
+
+// watch notes the progress token a host request asked for in
+// params._meta.progressToken, so its result can end the token's updates
+func (p *progressCoalescer) watch(msg rpcMessage) {
+	var params struct {
+		Meta struct {
+			ProgressToken json.RawMessage `json:"progressToken"`
+		} `json:"_meta"`
+	}
+	if json.Unmarshal(msg.Params, &params) != nil || len(params.Meta.ProgressToken) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests[string(msg.ID)] = string(params.Meta.ProgressToken)
+}
+
+// finish discards any update held for the request with the given id, once
+// its response is forwarded. Servers don't always send a final update, and
+// one held past the result would tell the host the request is still running.
+func (p *progressCoalescer) finish(id json.RawMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.requests[string(id)]
+	if !ok {
+		return
+	}
+	delete(p.requests, string(id))
+	if token := p.tokens[key]; token != nil && token.flush != nil {
+		token.flush.Stop()
+	}
+	delete(p.tokens, key)
+}
+
+// allow reports whether msg should be forwarded now. Updates it returns
+// false for are dropped or held for the end of the interval.
+func (p *progressCoalescer) allow(msg rpcMessage, data []byte) bool {
+	if msg.Method != "notifications/progress" {
+		return true
+	}
+	var params progressParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params.ProgressToken) == 0 {
+		return true
+	}
+	key := string(params.ProgressToken)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	p.prune(now)
+	token := p.tokens[key]
+
+	// The final update discards anything held so it is never overtaken
+	if params.Total != nil && params.Progress >= *params.Total {
+		if token != nil && token.flush != nil {
+			token.flush.Stop()
+		}
+		delete(p.tokens, key)
+		return true
+	}
+
+	if token == nil {
+		p.tokens[key] = &progressToken{lastSent: now}
+		return true
+	}
+	if wait := p.interval - now.Sub(token.lastSent); wait > 0 {
+		token.held = data
+		if token.flush == nil {
+			token.flush = p.clock.AfterFunc(wait, func() { p.flushHeld(key, token) })
+		}
+		return false
+	}
+	token.lastSent = now
+	token.held = nil
+	return true
+}
+
+// flushHeld forwards the update held for a token at the end of its
+// interval. It writes under the lock so a final update can't overtake it.
+func (p *progressCoalescer) flushHeld(key string, token *progressToken) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	token.flush = nil
+	if p.tokens[key] != token || token.held == nil {
+		return
+	}
+	p.write(token.held)
+	token.held = nil
+	token.lastSent = p.clock.Now()
+}
+
+// prune forgets idle tokens whose operation never sent a final update
+func (p *progressCoalescer) prune(now time.Time) {
+	for key, token := range p.tokens {
+		if token.held == nil && now.Sub(token.lastSent) > progressTokenIdle {
+			delete(p.tokens, key)
+		}
+	}
+}
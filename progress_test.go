@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func progressUpdate(n int) []byte {
+	return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"notifications/progress","params":{"progressToken":"t","progress":%d,"total":10}}`, n))
+}
+
+func TestProgressIsCoalescedPerInterval(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	clk := newFakeClock()
+	c, out := newTestClientWithClock(t, srv.URL, map[string]string{
+		"ARCPOINT_COALESCE_PROGRESS":          "true",
+		"ARCPOINT_COALESCE_PROGRESS_INTERVAL": "1s",
+	}, clk)
+
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x","_meta":{"progressToken":"t"}}}`)
+	c.forwardMessage(progressUpdate(1))
+	c.forwardMessage(progressUpdate(2))
+	c.forwardMessage(progressUpdate(3))
+	// The newest held update is delivered when the interval ends
+	clk.Advance(time.Second)
+	c.forwardMessage(progressUpdate(4))
+	// The result arrives while update 4 is held, which must not follow it
+	c.forwardMessage([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	clk.Advance(time.Second)
+
+	got := flushOutput(t, c, out)
+	var progress []string
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+		if i := strings.Index(line, `"progress":`); i >= 0 {
+			progress = append(progress, line[i+len(`"progress":`):i+len(`"progress":`)+1])
+		}
+	}
+	if strings.Join(progress, ",") != "1,3" {
+		t.Errorf("forwarded progress %v, want [1 3]\n%s", progress, got)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(got), `{"jsonrpc":"2.0","id":1,"result":{}}`) {
+		t.Errorf("result was not the last frame:\n%s", got)
+	}
+}
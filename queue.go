@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Ways ARCPOINT_QUEUE_OVERFLOW can handle a message that arrives while the
+// outgoing queue is full
+const (
+	// queueOverflowError answers the new message with an error
+	queueOverflowError = "error"
+	// queueOverflowDropOldest discards the longest-waiting message
+	queueOverflowDropOldest = "drop-oldest"
+	// queueOverflowDropNewest discards the new message
+	queueOverflowDropNewest = "drop-newest"
+)
+
+// queuedMessage is a host message waiting for its stream's session
+type queuedMessage struct {
+	ctx    context.Context
+	stream *sseStream
+	line   []byte
+	msg    rpcMessage
+}
+
+// outgoingQueue holds host messages sent before their stream has a session,
+// so they are posted in order once it does instead of without one
+type outgoingQueue struct {
+	mu    sync.Mutex
+	items []queuedMessage
+	// flushing marks streams whose queued messages are being posted
+	flushing map[*sseStream]bool
+}
+
+// newOutgoingQueue creates an empty outgoing queue
+func newOutgoingQueue() *outgoingQueue {
+	return &outgoingQueue{flushing: make(map[*sseStream]bool)}
+}
+
+// waiting reports whether messages for s are queued or being flushed.
+// q.mu must be held.
+func (q *outgoingQueue) waiting(s *sseStream) bool {
+	if q.flushing[s] {
+		return true
+	}
+	for _, item := range q.items {
+		if item.stream == s {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes and returns the first message queued for s. q.mu must be
+// held.
+func (q *outgoingQueue) take(s *sseStream) (queuedMessage, bool) {
+	for i, item := range q.items {
+		if item.stream == s {
+			q.items = append(q.items[:i:i], q.items[i+1:]...)
+			return item, true
+		}
+	}
+	return queuedMessage{}, false
+}
+
+// holdMessage queues a message for stream s while s has no session, such
+// as before the first endpoint event or while reconnecting, or while
+// earlier messages for s are still waiting, so they reach the server in the
+// order the host sent them. It reports whether the message was
+// taken, including when a full queue refused or dropped it.
+func (c *SSEClient) holdMessage(ctx context.Context, s *sseStream, line []byte, msg rpcMessage) bool {
+	if c.cfg.QueueSize == 0 || c.cfg.Transport == transportStreamableHTTP {
+		return false
+	}
+	q := c.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if s.getSessionID() != "" && !q.waiting(s) {
+		return false
+	}
+
+	if len(q.items) >= c.cfg.QueueSize {
+		switch c.cfg.QueueOverflow {
+		case queueOverflowDropNewest:
+			log.Printf("Warning: outgoing queue full (%d messages), dropping %s", len(q.items), describeMessage(msg))
+			c.dropMessage(msg)
+			return true
+		case queueOverflowDropOldest:
+			oldest := q.items[0]
+			q.items = q.items[1:]
+			log.Printf("Warning: outgoing queue full (%d messages), dropping the oldest, %s", c.cfg.QueueSize, describeMessage(oldest.msg))
+			c.dropMessage(oldest.msg)
+		default:
+			log.Printf("Outgoing queue full (%d messages), refusing %s", len(q.items), describeMessage(msg))
+			if msg.isRequest() {
+				c.failRequest(msg.ID, -32603, "Outgoing queue full: the session is not established yet")
+			}
+			return true
+		}
+	}
+	q.items = append(q.items, queuedMessage{ctx: ctx, stream: s, line: line, msg: msg})
+	debugf("%sQueued %s until the session is established (%d queued)", s.label, describeMessage(msg), len(q.items))
+	return true
+}
+
+// flushQueue posts the messages queued for s, in order, once s has a
+// session. Messages the host sends meanwhile queue behind them. Posts are
+// spaced FlushInterval apart so a backlog doesn't hit the server at once.
+func (c *SSEClient) flushQueue(ctx context.Context, s *sseStream) {
+	q := c.queue
+	q.mu.Lock()
+	if q.flushing[s] {
+		q.mu.Unlock()
+		return
+	}
+	q.flushing[s] = true
+	q.mu.Unlock()
+
+	for sent := 0; ; sent++ {
+		if sent > 0 && c.cfg.FlushInterval > 0 {
+			c.sleep(ctx, c.cfg.FlushInterval)
+		}
+		q.mu.Lock()
+		var next queuedMessage
+		ok := ctx.Err() == nil
+		if ok {
+			next, ok = q.take(s)
+		}
+		if !ok {
+			delete(q.flushing, s)
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+		c.postToStream(next.ctx, next.stream, next.line, next.msg)
+	}
+}
+
+// dropMessage discards a queued message, answering it with an error if it
+// is a request so the host isn't left waiting for a response
+func (c *SSEClient) dropMessage(msg rpcMessage) {
+	if msg.isRequest() {
+		c.failRequest(msg.ID, -32603, "Request dropped from the outgoing queue: too many messages waiting for the session")
+	}
+}
+
+// describeMessage names a message for logs
+func describeMessage(msg rpcMessage) string {
+	if msg.isRequest() {
+		return msg.Method + " (id " + string(msg.ID) + ")"
+	}
+	if msg.Method != "" {
+		return msg.Method
+	}
+	return "response " + string(msg.ID)
+}
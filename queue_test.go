@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		posted []string
+		// failed is the request answered with an error, and reason the
+		// error's message
+		failed string
+		reason string
+	}{
+		{"error", []string{"1", "2"}, "3", "Outgoing queue full"},
+		{"drop-oldest", []string{"2", "3"}, "1", "dropped from the outgoing queue"},
+		{"drop-newest", []string{"1", "2"}, "3", "dropped from the outgoing queue"},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var posted []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			posted = append(posted, string(parseMessage(body).ID))
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		captureLog(t)
+		c, out := newTestClient(t, srv.URL, map[string]string{
+			"ARCPOINT_QUEUE_SIZE":     "2",
+			"ARCPOINT_QUEUE_OVERFLOW": tt.policy,
+		})
+		s := c.streams[0]
+		s.setSessionID("")
+		for _, id := range []string{"1", "2", "3"} {
+			send(c, `{"jsonrpc":"2.0","id":`+id+`,"method":"tools/list"}`)
+		}
+		mu.Lock()
+		if len(posted) != 0 {
+			t.Errorf("%s: %v posted before the session was established", tt.policy, posted)
+		}
+		mu.Unlock()
+
+		if err := c.handleEvent(s, "endpoint", "", []string{"/message?sessionId=s1"}); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			n := len(posted)
+			mu.Unlock()
+			if n >= len(tt.posted) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		got := flushOutput(t, c, out)
+		srv.Close()
+
+		mu.Lock()
+		if !slices.Equal(posted, tt.posted) {
+			t.Errorf("%s: posted %v, want %v", tt.policy, posted, tt.posted)
+		}
+		mu.Unlock()
+		if strings.Count(got, "\n") != 1 || !strings.Contains(got, `"id":`+tt.failed) || !strings.Contains(got, tt.reason) {
+			t.Errorf("%s: want one %q error for id %s, got %q", tt.policy, tt.reason, tt.failed, got)
+		}
+	}
+}
+
+func TestQueuedMessagesKeepOrderBehindFlush(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, string(parseMessage(body).ID))
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_QUEUE_SIZE": "10"})
+	s := c.streams[0]
+	s.setSessionID("")
+	for _, id := range []string{"1", "2", "3"} {
+		send(c, `{"jsonrpc":"2.0","id":`+id+`,"method":"tools/list"}`)
+	}
+	c.handleEvent(s, "endpoint", "", []string{"/message?sessionId=s1"})
+	// Sent while the queue is still flushing, so it must wait its turn
+	send(c, `{"jsonrpc":"2.0","id":4,"method":"tools/list"}`)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(posted)
+		mu.Unlock()
+		if n >= 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	flushOutput(t, c, out)
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"1", "2", "3", "4"}; !slices.Equal(posted, want) {
+		t.Errorf("posted %v, want %v", posted, want)
+	}
+}
+
+func TestQueueFlushIsPaced(t *testing.T) {
+	var posts atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	clk := newFakeClock()
+	c, out := newTestClientWithClock(t, srv.URL, map[string]string{
+		"ARCPOINT_QUEUE_SIZE":     "10",
+		"ARCPOINT_FLUSH_INTERVAL": "1s",
+	}, clk)
+	defer flushOutput(t, c, out)
+	s := c.streams[0]
+	s.setSessionID("")
+	for _, id := range []string{"1", "2", "3"} {
+		send(c, `{"jsonrpc":"2.0","id":`+id+`,"method":"tools/list"}`)
+	}
+	// Drop the timers the requests started for the stdin EOF wait
+	for len(clk.started) > 0 {
+		<-clk.started
+	}
+
+	s.setSessionID("s1")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.flushQueue(ctx, s)
+	}()
+	for want := int64(1); want <= 2; want++ {
+		if d := <-clk.started; d != time.Second {
+			t.Fatalf("waited %s between posts, want 1s", d)
+		}
+		if n := posts.Load(); n != want {
+			t.Errorf("%d posts before the wait, want %d", n, want)
+		}
+		if want == 1 {
+			clk.Advance(time.Second)
+		}
+	}
+	// Cancelling ends the wait without posting the last message
+	cancel()
+	<-done
+	if n := posts.Load(); n != 2 {
+		t.Errorf("%d posts after cancelling, want 2", n)
+	}
+}
+
+func TestMessagesAreQueuedWhileReconnecting(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	connected := make(chan struct{}, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: endpoint\ndata: /message?sessionId=s1\n\n")
+		w.(http.Flusher).Flush()
+		connected <- struct{}{}
+	})
+	mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, string(parseMessage(body).ID))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{"ARCPOINT_QUEUE_SIZE": "10"})
+	defer flushOutput(t, c, out)
+	s := c.streams[0]
+
+	// The stream connects, gets a session and is then dropped by the server
+	c.connectSSE(context.Background(), s)
+	<-connected
+	if id := s.getSessionID(); id != "" {
+		t.Fatalf("session %q outlived its stream", id)
+	}
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	mu.Lock()
+	if len(posted) != 0 {
+		t.Errorf("%v posted while disconnected", posted)
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconnectCmdTimeout bounds how long ARCPOINT_ON_RECONNECT_CMD may run
+const reconnectCmdTimeout = 30 * time.Second
+
+// runReconnectCommand runs ARCPOINT_ON_RECONNECT_CMD in the background with
+// details of the reconnect in its environment. The outcome is only logged,
+// so a failing or hanging command never affects the client.
+func (c *SSEClient) runReconnectCommand(s *sseStream, reason string, cause error) {
+	if c.cfg.OnReconnectCmd == "" {
+		return
+	}
+
+	env := reconnectCommandEnv()
+	env = append(env,
+		"ARCPOINT_RECONNECT_REASON="+reason,
+		"ARCPOINT_RECONNECT_STREAM="+s.path,
+		"ARCPOINT_RECONNECT_TIME="+c.clock.Now().UTC().Format(time.RFC3339),
+	)
+	if cause != nil {
+		env = append(env, "ARCPOINT_RECONNECT_ERROR="+cause.Error())
+	}
+	if sessionID := s.getSessionID(); sessionID != "" {
+		env = append(env, "ARCPOINT_PREVIOUS_SESSION_ID="+sessionID)
+	}
+	env = append(env, "ARCPOINT_RECONNECT_COUNT="+strconv.FormatInt(c.metrics.totalReconnects(), 10))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectCmdTimeout)
+		defer cancel()
+		cmd := shellCommand(ctx, c.cfg.OnReconnectCmd)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		out = bytes.TrimSpace(out)
+		switch {
+		case err != nil && len(out) > 0:
+			log.Printf("Warning: ARCPOINT_ON_RECONNECT_CMD failed: %v: %s", err, out)
+		case err != nil:
+			log.Printf("Warning: ARCPOINT_ON_RECONNECT_CMD failed: %v", err)
+		case len(out) > 0:
+			debugf("ARCPOINT_ON_RECONNECT_CMD output: %s", out)
+		}
+	}()
+}
+
+// reconnectCommandSecrets are variables never passed to the reconnect
+// command
+var reconnectCommandSecrets = map[string]bool{
+	"ARCPOINT_API_TOKEN":  true,
+	"ARCPOINT_API_TOKENS": true,
+	"ARCPOINT_PROXY_PASS": true,
+}
+
+// reconnectCommandEnv returns the client's environment without the API
+// tokens or proxy password, so the hook command doesn't receive them unless
+// it asks elsewhere
+func reconnectCommandEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); reconnectCommandSecrets[name] {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReconnectCommandEnvOmitsSecrets(t *testing.T) {
+	t.Setenv("ARCPOINT_API_TOKEN", "apt_single")
+	t.Setenv("ARCPOINT_API_TOKENS", "apt_one,apt_two")
+	t.Setenv("ARCPOINT_PROXY_PASS", "hunter2")
+	t.Setenv("ARCPOINT_QUIET", "true")
+
+	env := reconnectCommandEnv()
+	for _, kv := range env {
+		if name, _, _ := strings.Cut(kv, "="); reconnectCommandSecrets[name] {
+			t.Errorf("reconnect command environment contains %s", name)
+		}
+	}
+	if !strings.Contains(strings.Join(env, "\n"), "ARCPOINT_QUIET=true") {
+		t.Error("reconnect command environment lost ARCPOINT_QUIET")
+	}
+}
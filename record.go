@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of entry in a session recording
+const (
+	recordStdin    = "stdin"    // a message from the host
+	recordStdout   = "stdout"   // a frame written to the host
+	recordSSE      = "sse"      // an event received on an SSE stream
+	recordResponse = "response" // an immediate message POST response body
+)
+
+// recordEntry is one line of a session recording
+type recordEntry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Stream string    `json:"stream,omitempty"`
+	Event  string    `json:"event,omitempty"`
+	Data   string    `json:"data"`
+}
+
+// sessionRecorder appends timestamped entries to a recording as JSON lines
+type sessionRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	// failed is set once a write fails and the file is closed
+	failed bool
+}
+
+// startRecording records the session to path, truncating any previous
+// recording there
+func (c *SSEClient) startRecording(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot open ARCPOINT_RECORD file: %w", err)
+	}
+	c.recorder.Store(&sessionRecorder{f: f, enc: json.NewEncoder(f)})
+	c.out.tap = func(line []byte) { c.record(recordStdout, "", "", line) }
+	log.Printf("Recording session to %s", path)
+	return nil
+}
+
+// record appends an entry to the recording, if one is being made
+func (c *SSEClient) record(kind, stream, event string, data []byte) {
+	r := c.recorder.Load()
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	if err := r.enc.Encode(recordEntry{Time: c.clock.Now(), Kind: kind, Stream: stream, Event: event, Data: string(data)}); err != nil {
+		log.Printf("Failed to write recording, stopping it: %v", err)
+		r.failed = true
+		c.recorder.CompareAndSwap(r, nil)
+		r.f.Close()
+	}
+}
+
+// replay plays a recording back to the host instead of connecting to the
+// server. Recorded SSE events and responses go through the normal inbound
+// path, and each recorded host message waits for the host's next message
+// so the conversation stays in step.
+func (c *SSEClient) replay(ctx context.Context) error {
+	f, err := os.Open(c.cfg.ReplayPath)
+	if err != nil {
+		return fmt.Errorf("cannot open ARCPOINT_REPLAY file: %w", err)
+	}
+	defer f.Close()
+	log.Printf("Replaying session from %s", c.cfg.ReplayPath)
+
+	hostLines := make(chan []byte)
+	go func() {
+		defer close(hostLines)
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			select {
+			case hostLines <- append([]byte(nil), scanner.Bytes()...):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	decoder := json.NewDecoder(f)
+	for n := 1; ; n++ {
+		var entry recordEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				log.Println("Replay complete")
+				return nil
+			}
+			return fmt.Errorf("reading replay entry %d: %w", n, err)
+		}
+
+		switch entry.Kind {
+		case recordStdin:
+			var line []byte
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return nil
+			case line, ok = <-hostLines:
+			}
+			if !ok {
+				log.Println("Host closed stdin, stopping replay")
+				return nil
+			}
+			msg := parseMessage(line)
+			if want := parseMessage([]byte(entry.Data)).Method; msg.Method != want {
+				log.Printf("Replay diverged at entry %d: host sent %q, recording has %q", n, msg.Method, want)
+			}
+			// Internal ids are handed out in order, so a host repeating
+			// the recorded conversation gets the same ones back
+			if msg.isRequest() && c.cfg.RewriteIDs {
+				c.ids.outbound(line, msg.ID)
+			}
+		case recordSSE:
+			err := c.handleEvent(c.streamByPath(entry.Stream), entry.Event, "", strings.Split(entry.Data, "\n"))
+			var exitErr *exitError
+			if errors.As(err, &exitErr) {
+				return err
+			}
+		case recordResponse:
+			c.forwardMessage([]byte(entry.Data))
+		case recordStdout:
+			// Regenerated by replaying the entries that produced it
+		default:
+			log.Printf("Ignoring replay entry %d of unknown kind %q", n, entry.Kind)
+		}
+	}
+}
+
+// streamByPath returns the stream with the given path, or the first stream
+func (c *SSEClient) streamByPath(path string) *sseStream {
+	for _, s := range c.streams {
+		if s.path == path {
+			return s
+		}
+	}
+	return c.streams[0]
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordingStopsSafelyWhenWritesFail(t *testing.T) {
+	captureLog(t)
+	c, out := newTestClient(t, "http://127.0.0.1:0", nil)
+	defer flushOutput(t, c, out)
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := c.startRecording(path); err != nil {
+		t.Fatal(err)
+	}
+	c.record(recordStdin, "", "", []byte(`{"jsonrpc":"2.0","id":1,"method":"ping"}`))
+
+	// Writes after the file is closed fail, and every goroutine recording
+	// at the time must see the recorder stop without racing
+	c.recorder.Load().f.Close()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				c.record(recordSSE, "/sse", "message", []byte(`{}`))
+			}
+		}()
+	}
+	wg.Wait()
+	if c.recorder.Load() != nil {
+		t.Error("recorder still set after a failed write")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"kind":"stdin"`) {
+		t.Errorf("recording is missing the entry written before the failure: %s", data)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// errVersionChanged drops a connection after the server's version changed
+var errVersionChanged = errors.New("server version changed")
+
+// serverInfoCarrier matches the places a server advertises its version:
+// an initialize result, or the top level of a control event
+type serverInfoCarrier struct {
+	ServerInfo *struct {
+		Version string `json:"version"`
+	} `json:"serverInfo"`
+	Result *struct {
+		ServerInfo *struct {
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	} `json:"result"`
+}
+
+// serverVersion returns the server version advertised in data, or ""
+func serverVersion(data []byte) string {
+	var carrier serverInfoCarrier
+	if json.Unmarshal(data, &carrier) != nil {
+		return ""
+	}
+	if carrier.ServerInfo != nil {
+		return carrier.ServerInfo.Version
+	}
+	if carrier.Result != nil && carrier.Result.ServerInfo != nil {
+		return carrier.Result.ServerInfo.Version
+	}
+	return ""
+}
+
+// noteServerVersion records the server version advertised in data. When
+// it differs from the one seen before, which usually means a deploy, the
+// change is logged and, if configured, errVersionChanged is returned so the
+// stream reconnects to the new backend.
+func (c *SSEClient) noteServerVersion(s *sseStream, data []byte) error {
+	version := serverVersion(data)
+	if version == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	previous := s.serverVersion
+	s.serverVersion = version
+	s.mu.Unlock()
+
+	if previous == "" || previous == version {
+		return nil
+	}
+	log.Printf("%sServer version changed from %s to %s", s.label, previous, version)
+	if c.cfg.ReconnectOnVersionChange {
+		return errVersionChanged
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+)
+
+// A clean close within shortConnectionAge of connecting is short-lived, and
+// more than shortConnectionCount of them within shortConnectionWindow
+// suggests a server that doesn't keep SSE streams open
+const (
+	shortConnectionAge    = 10 * time.Second
+	shortConnectionCount  = 5
+	shortConnectionWindow = time.Minute
+)
+
+// shortConnections notices a server that keeps closing the SSE stream soon
+// after it opens, as pseudo-SSE servers do after each batch of events
+type shortConnections struct {
+	closes *reconnectBudget
+	// warned is set once the pattern has been reported, until a connection
+	// lasts long enough to end it
+	warned bool
+}
+
+// newShortConnections creates a detector with no closes recorded
+func newShortConnections() *shortConnections {
+	return &shortConnections{closes: newReconnectBudget(shortConnectionCount, shortConnectionWindow)}
+}
+
+// closed records a clean close of a connection that lasted age and reports
+// whether the short-lived pattern is under way
+func (d *shortConnections) closed(now time.Time, age time.Duration) bool {
+	if age >= shortConnectionAge {
+		d.closes = newReconnectBudget(shortConnectionCount, shortConnectionWindow)
+		d.warned = false
+		return false
+	}
+	return !d.closes.spend(now)
+}
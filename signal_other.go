@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyStateDump is a no-op on platforms without SIGUSR1
+func notifyStateDump(ch chan<- os.Signal) {}
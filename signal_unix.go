@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStateDump delivers SIGUSR1 on ch so the state can be dumped on
+// demand
+func notifyStateDump(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redactSessionID shortens a session id to a prefix that is enough to tell
+// sessions apart in logs without exposing the whole id
+func redactSessionID(id string) string {
+	keep := 4
+	if len(id) <= 8 {
+		keep = len(id) / 4
+	}
+	return id[:keep] + "..."
+}
+
+// logSessionID returns the form of a session id used in logs: redacted
+// unless ARCPOINT_LOG_FULL_SESSION is set
+func (c *SSEClient) logSessionID(id string) string {
+	if c.cfg.LogFullSession {
+		return id
+	}
+	return redactSessionID(id)
+}
+
+// sessionQuery matches a sessionId query parameter in a URL
+var sessionQuery = regexp.MustCompile(`sessionId=[^&\s"']+`)
+
+// redactSessionQuery redacts the session id of any message URL in text,
+// such as the one net/http includes in its errors, like logSessionID
+func (c *SSEClient) redactSessionQuery(text string) string {
+	if c.cfg.LogFullSession {
+		return text
+	}
+	return sessionQuery.ReplaceAllStringFunc(text, func(param string) string {
+		return "sessionId=" + redactSessionID(strings.TrimPrefix(param, "sessionId="))
+	})
+}
+
+// dumpState writes a snapshot of the client's state to stderr. It is
+// written directly rather than logged so it appears even in quiet mode.
+func (c *SSEClient) dumpState() {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Arcpoint MCP Client v%s state:\n", version)
+	for _, s := range c.streams {
+		status := "disconnected"
+		if s.connected.Load() {
+			status = "connected"
+		}
+		session := s.getSessionID()
+		if session == "" {
+			session = "(none)"
+		} else {
+			session = c.logSessionID(session)
+		}
+		fmt.Fprintf(&b, "  stream %s: %s, session %s\n", s.path, status, session)
+	}
+
+	status := c.metrics.status()
+	fmt.Fprintf(&b, "  connection attempts: %d\n", status.Attempts)
+	reasons := make([]string, 0, len(status.Reconnects))
+	reconnects := int64(0)
+	for reason, count := range status.Reconnects {
+		reconnects += count
+		reasons = append(reasons, fmt.Sprintf("%s %d", reason, count))
+	}
+	sort.Strings(reasons)
+	if len(reasons) > 0 {
+		fmt.Fprintf(&b, "  reconnects: %d (%s)\n", reconnects, strings.Join(reasons, ", "))
+	} else {
+		fmt.Fprintf(&b, "  reconnects: 0\n")
+	}
+	fmt.Fprintf(&b, "  in-flight POSTs: %d, pending requests: %d\n", c.inFlight.Load(), c.pending.count())
+	if last := c.lastEvent.Load(); last > 0 {
+		fmt.Fprintf(&b, "  last SSE event: %s ago\n", c.clock.Now().Sub(time.Unix(0, last)).Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(&b, "  last SSE event: never\n")
+	}
+	os.Stderr.WriteString(b.String())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// clientStatus is the document written to ARCPOINT_STATUS_FILE
+type clientStatus struct {
+	Version            string           `json:"version"`
+	Started            time.Time        `json:"started"`
+	Attempts           int64            `json:"attempts"`
+	LastConnected      *time.Time       `json:"lastConnected,omitempty"`
+	Reconnects         map[string]int64 `json:"reconnects"`
+	MalformedEndpoints int64            `json:"malformedEndpoints,omitempty"`
+	Events             []connEvent      `json:"events"`
+}
+
+// recordEvent adds a connection event to the event log and refreshes the
+// status file
+func (c *SSEClient) recordEvent(ev connEvent) {
+	ev.Time = c.clock.Now()
+	c.events.add(ev)
+	c.writeStatus()
+}
+
+// writeStatus replaces the status file, if one is configured. The file is
+// written beside the target and renamed so readers never see it half
+// written.
+func (c *SSEClient) writeStatus() {
+	if c.cfg.StatusFile == "" {
+		return
+	}
+
+	status := c.metrics.status()
+	status.Version = version
+	status.Events = c.events.snapshot()
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode status: %v", err)
+		return
+	}
+
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(c.cfg.StatusFile), ".arcpoint-status-*")
+	if err != nil {
+		log.Printf("Failed to write status file: %v", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.cfg.StatusFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to write status file: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+)
+
+// Transport modes selectable with ARCPOINT_TRANSPORT
+const (
+	// transportSSE is the legacy HTTP+SSE transport: a long-lived GET /sse
+	// stream announces the session via an endpoint event
+	transportSSE = "sse"
+	// transportStreamableHTTP is the Streamable HTTP transport: messages are
+	// POSTed to a single endpoint and the session is carried in a header
+	transportStreamableHTTP = "streamable-http"
+)
+
+// sessionHeader carries the Streamable HTTP session id in both directions
+const sessionHeader = "Mcp-Session-Id"
+
+// updateStreamableSession stores the session id the server assigned in a
+// message response, typically the one answering initialize
+func (c *SSEClient) updateStreamableSession(resp *http.Response) {
+	id := resp.Header.Get(sessionHeader)
+	if id == "" || id == c.getSessionID() {
+		return
+	}
+	c.setSessionID(id)
+	log.Printf("Session established: %s", c.logSessionID(id))
+}
+
+// isEventStream reports whether a response carries an SSE stream
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// terminateSession asks the server to tear down the current session. Errors
+// are ignored since this only runs while shutting down.
+func (c *SSEClient) terminateSession(ctx context.Context) {
+	sessionID := c.getSessionID()
+	if sessionID == "" {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.base()+c.cfg.MCPPath, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+c.tokens.pick())
+	req.Header.Set("User-Agent", fmt.Sprintf("arcpoint-mcp-client/%s", version))
+	c.setInstanceHeader(req)
+	req.Header.Set(sessionHeader, sessionID)
+
+	resp, err := c.msgClient.Do(req)
+	if err != nil {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	log.Println("Session terminated")
+}
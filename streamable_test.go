@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseSharesShutdownGraceWithSessionDelete(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	c, _ := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_TRANSPORT":              transportStreamableHTTP,
+		"ARCPOINT_DELETE_SESSION_ON_EXIT": "true",
+		"ARCPOINT_SHUTDOWN_GRACE":         "300ms",
+	})
+	// Output that never drains makes Close wait for its flush too
+	blocked := make(chan struct{})
+	defer close(blocked)
+	c.out = newOutputWriter(blockingWriter(blocked), "\n", false, false, realClock{})
+	c.out.WriteLine([]byte(`{"jsonrpc":"2.0","method":"x"}`))
+
+	started := time.Now()
+	c.Close()
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("Close took %s with a 300ms shutdown grace", elapsed)
+	}
+}
+
+func TestVersionChangeDoesNotCutStreamableResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/message\",\"params\":{\"serverInfo\":{}}}\n\n")
+		fmt.Fprint(w, "event: control\ndata: {\"serverInfo\":{\"version\":\"2\"}}\n\n")
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\n\n")
+	}))
+	defer srv.Close()
+
+	captureLog(t)
+	c, out := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_TRANSPORT":                   transportStreamableHTTP,
+		"ARCPOINT_RECONNECT_ON_VERSION_CHANGE": "true",
+	})
+	c.noteServerVersion(c.streams[0], []byte(`{"serverInfo":{"version":"1"}}`))
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"x"}}`)
+	if got := flushOutput(t, c, out); !strings.Contains(got, `"id":1,"result"`) {
+		t.Errorf("result after the version change was lost, got %q", got)
+	}
+}
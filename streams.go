@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sseStream is one SSE connection and the session its endpoint event
+// established. Unless ARCPOINT_STREAMS lists several, there is a single
+// stream at /sse.
+type sseStream struct {
+	path string
+	// label prefixes log lines when several streams are open
+	label string
+	// connectedOnce is set after the first successful connection
+	connectedOnce atomic.Bool
+	// connected is set while the stream is connected
+	connected atomic.Bool
+	// connectedAt is when the stream last connected, in Unix nanoseconds
+	connectedAt atomic.Int64
+	// endpointEvents counts endpoint events, for the endpoint watchdog
+	endpointEvents atomic.Int64
+	// frames counts event: and data: lines, to tell an SSE stream from
+	// some other body
+	frames atomic.Int64
+	// failures coalesces repeated connection failure logs
+	failures  *failureLog
+	mu        sync.RWMutex
+	sessionID string
+	// endpoint is the resolved message URL from the endpoint event
+	endpoint string
+	// token is the API token the stream last connected with
+	token string
+	// serverVersion is the last version the server advertised
+	serverVersion string
+	// fragments buffers a message split across several events
+	fragments []byte
+	// outageStart is when the stream last lost its session, zero once a
+	// session is established again
+	outageStart time.Time
+}
+
+// newStreams creates a stream for each configured path
+func newStreams(paths []string, failureLogInterval time.Duration, clk clock) []*sseStream {
+	streams := make([]*sseStream, len(paths))
+	for i, path := range paths {
+		streams[i] = &sseStream{path: path, failures: newFailureLog(failureLogInterval, clk)}
+		if len(paths) > 1 {
+			streams[i].label = "[" + path + "] "
+		}
+	}
+	return streams
+}
+
+// setSessionID safely sets the stream's session ID
+func (s *sseStream) setSessionID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionID = id
+}
+
+// getSessionID safely gets the stream's session ID
+func (s *sseStream) getSessionID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessionID
+}
+
+// markOutage records that the stream lost its session at now, unless an
+// outage is already under way
+func (s *sseStream) markOutage(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outageStart.IsZero() {
+		s.outageStart = now
+	}
+}
+
+// endOutage records that the stream has a session again
+func (s *sseStream) endOutage() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outageStart = time.Time{}
+}
+
+// outage returns how long the stream has been without a session, or 0 if
+// it has one or never had one
+func (s *sseStream) outage(now time.Time) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.outageStart.IsZero() {
+		return 0
+	}
+	return now.Sub(s.outageStart)
+}
+
+// setToken safely sets the token the stream connected with
+func (s *sseStream) setToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// getToken safely gets the token the stream connected with, "" before it
+// first connects
+func (s *sseStream) getToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.token
+}
+
+// setEndpoint safely sets the stream's message URL
+func (s *sseStream) setEndpoint(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoint = endpoint
+}
+
+// getEndpoint safely gets the stream's message URL, "" until the server
+// advertises one
+func (s *sseStream) getEndpoint() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.endpoint
+}
+
+// serverRoute is where a server request forwarded to the host came from
+type serverRoute struct {
+	stream *sseStream
+	// id is the request's id as the server sent it
+	id json.RawMessage
+}
+
+// streamFor picks the stream a host message is posted on and returns the
+// message to post. Responses go back to the stream the server's request
+// arrived on under that request's original id, requests may name a stream
+// in params._meta, and everything else goes to the first stream.
+func (c *SSEClient) streamFor(msg rpcMessage, data []byte) (*sseStream, []byte) {
+	if len(c.streams) == 1 {
+		return c.streams[0], data
+	}
+	if msg.isResponse() {
+		c.mu.Lock()
+		route, ok := c.routes[string(msg.ID)]
+		delete(c.routes, string(msg.ID))
+		c.mu.Unlock()
+		if ok {
+			restored, err := replaceID(data, route.id)
+			if err != nil {
+				log.Printf("Failed to restore server request id: %v", err)
+				return route.stream, data
+			}
+			return route.stream, restored
+		}
+	}
+	if path := msg.streamHint(); path != "" {
+		for _, s := range c.streams {
+			if s.path == path {
+				return s, data
+			}
+		}
+	}
+	return c.streams[0], data
+}
+
+// routeRequest gives a server request arriving on stream s an id unique
+// across streams, since each session picks its ids independently, and
+// remembers where it came from so the host's response can be posted back
+// to the same session under the original id
+func (c *SSEClient) routeRequest(s *sseStream, data []byte) []byte {
+	if len(c.streams) == 1 {
+		return data
+	}
+	msg := parseMessage(data)
+	if !msg.isRequest() {
+		return data
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routeSeq++
+	hostID := json.RawMessage(strconv.Quote("arcpoint-server-" + strconv.FormatUint(c.routeSeq, 10)))
+	rewritten, err := replaceID(data, hostID)
+	if err != nil {
+		log.Printf("%sFailed to rewrite server request id: %v", s.label, err)
+		hostID, rewritten = msg.ID, data
+	}
+	c.routes[string(hostID)] = serverRoute{stream: s, id: msg.ID}
+	return rewritten
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// annotateRTT adds the client-observed round trip of a request to its
+// response as result._meta.arcpointRttMs. The field is spliced in so every
+// other byte is left as it was. Responses without an object result, or
+// whose _meta isn't an object or already has the field, are unchanged.
+func annotateRTT(data []byte, rtt time.Duration) []byte {
+	field := []byte(`"arcpointRttMs":` + strconv.FormatInt(rtt.Milliseconds(), 10))
+
+	start, end, err := fieldSpan(data, "result")
+	if err != nil || start < 0 || data[start] != '{' {
+		return data
+	}
+	result := data[start:end]
+	metaStart, metaEnd, err := fieldSpan(result, "_meta")
+	if err != nil {
+		return data
+	}
+	if metaStart < 0 {
+		return insertField(data, start, []byte(`"_meta":{`+string(field)+`}`))
+	}
+
+	meta := result[metaStart:metaEnd]
+	if meta[0] != '{' {
+		return data
+	}
+	if existing, _, err := fieldSpan(meta, "arcpointRttMs"); err != nil || existing >= 0 {
+		return data
+	}
+	return insertField(data, start+metaStart, field)
+}
+
+// insertField returns a copy of data with field added as the first member
+// of the JSON object that opens at offset
+func insertField(data []byte, offset int, field []byte) []byte {
+	out := make([]byte, 0, len(data)+len(field)+1)
+	out = append(out, data[:offset+1]...)
+	out = append(out, field...)
+	if rest := bytes.TrimLeft(data[offset+1:], " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, data[offset+1:]...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// tlsDiagnosis describes the likely cause of a TLS failure, or returns ""
+// if err isn't TLS related
+func tlsDiagnosis(err error) string {
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	switch {
+	case errors.As(err, &recordErr):
+		return "the server did not respond with TLS - check that ARCPOINT_API_URL uses the right scheme and port"
+	case errors.As(err, &unknownAuthority):
+		return "the server certificate is signed by an unknown authority - a proxy may be intercepting TLS"
+	case errors.As(err, &invalidCert):
+		if invalidCert.Reason == x509.Expired {
+			return "the server certificate has expired or the system clock is wrong"
+		}
+		return "the server certificate is not valid"
+	case errors.As(err, &hostnameErr):
+		return "the server certificate does not match the hostname in ARCPOINT_API_URL"
+	case errors.As(err, &verifyErr):
+		return "the server certificate could not be verified"
+	case errors.As(err, &alertErr):
+		return "the server rejected the TLS handshake - the TLS version or server name may not be supported"
+	default:
+		return ""
+	}
+}
+
+// isCertificateError reports whether err is a certificate verification
+// failure, which retrying won't fix
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var verifyErr *tls.CertificateVerificationError
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &invalidCert) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &verifyErr)
+}
+
+// insecureURL reports whether rawURL would send the token in cleartext to
+// another machine. Plain http to localhost is fine for local development.
+func insecureURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
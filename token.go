@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// tokenSourceAttempts bounds how many times an empty token file or command
+// is re-read before giving up
+const tokenSourceAttempts = 5
+
+// tokenCommandTimeout bounds how long ARCPOINT_API_TOKEN_COMMAND may run, so
+// a hung credential helper can't block startup
+const tokenCommandTimeout = 30 * time.Second
+
+// tokenFromSources reads the API token from ARCPOINT_API_TOKEN_FILE or
+// ARCPOINT_API_TOKEN_COMMAND. It returns "" with no error when neither is
+// set. An empty result usually means a secrets mount hasn't been populated
+// yet, so the source is re-read with backoff rather than sending an empty
+// Bearer header.
+func tokenFromSources(clk clock) (string, error) {
+	file := strings.TrimSpace(os.Getenv("ARCPOINT_API_TOKEN_FILE"))
+	command := strings.TrimSpace(os.Getenv("ARCPOINT_API_TOKEN_COMMAND"))
+	var read func() (string, error)
+	var source string
+	switch {
+	case file != "" && command != "":
+		return "", fmt.Errorf("set only one of ARCPOINT_API_TOKEN_FILE and ARCPOINT_API_TOKEN_COMMAND")
+	case file != "":
+		source = "ARCPOINT_API_TOKEN_FILE " + file
+		read = func() (string, error) { return readTokenFile(file) }
+	case command != "":
+		source = "ARCPOINT_API_TOKEN_COMMAND"
+		read = func() (string, error) { return runTokenCommand(command, tokenCommandTimeout) }
+	default:
+		return "", nil
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		token, err := read()
+		if err != nil {
+			return "", fmt.Errorf("reading token from %s: %w", source, err)
+		}
+		if token != "" {
+			return token, nil
+		}
+		if attempt >= tokenSourceAttempts {
+			return "", fmt.Errorf("token from %s is still empty after %d attempts", source, attempt)
+		}
+		log.Printf("Token from %s is empty (secret not provisioned yet?), retrying in %s (attempt %d/%d)",
+			source, delay, attempt, tokenSourceAttempts)
+		clk.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// readTokenFile returns the trimmed contents of a token file
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runTokenCommand runs command through the shell and returns its trimmed
+// output
+func runTokenCommand(command string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	// Don't wait on a child of the shell that still holds the output open
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%q did not finish within %s", command, timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// shellCommand prepares command to run through the platform's shell
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCommandTimesOut(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	started := time.Now()
+	_, err := runTokenCommand("sleep 30", 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), `"sleep 30"`) {
+		t.Errorf("got %v, want a timeout naming the command", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("hung command held the token read for %s", elapsed)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Ways ARCPOINT_TOKEN_POLICY can choose among several API tokens
+const (
+	// tokenPolicyRoundRobin uses each token in turn, one per request
+	tokenPolicyRoundRobin = "round-robin"
+	// tokenPolicyFailover sticks with one token until it is rejected or
+	// throttled, then moves to the next
+	tokenPolicyFailover = "failover"
+)
+
+// tokenPool holds the API tokens requests are authorized with. With a
+// single token it always returns that token.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []string
+	policy string
+	// next is the round-robin cursor, or the current token for failover
+	next int
+}
+
+// newTokenPool creates a pool of tokens chosen by policy
+func newTokenPool(tokens []string, policy string) *tokenPool {
+	return &tokenPool{tokens: tokens, policy: policy}
+}
+
+// pick returns the token for the next request
+func (p *tokenPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	token := p.tokens[p.next%len(p.tokens)]
+	if p.policy == tokenPolicyRoundRobin {
+		p.next++
+	}
+	return token
+}
+
+// noteStatus moves a failover pool on to the next token when the current
+// one gets a status meaning it was rejected or throttled
+func (p *tokenPool) noteStatus(token string, status int) {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+	default:
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.policy != tokenPolicyFailover || len(p.tokens) < 2 || p.tokens[p.next%len(p.tokens)] != token {
+		return
+	}
+	p.next = (p.next + 1) % len(p.tokens)
+	log.Printf("Token %s got HTTP %d, switching to %s (token %d of %d)",
+		maskToken(token), status, maskToken(p.tokens[p.next]), p.next+1, len(p.tokens))
+}
+
+// redact replaces every token in text
+func (p *tokenPool) redact(text string) string {
+	for _, token := range p.tokens {
+		if token != "" {
+			text = strings.ReplaceAll(text, token, "[REDACTED]")
+		}
+	}
+	return text
+}
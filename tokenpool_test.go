@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestLegacySessionPostsUseTheStreamToken(t *testing.T) {
+	var mu sync.Mutex
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	c, out := newTestClient(t, srv.URL, map[string]string{
+		"ARCPOINT_API_TOKENS":   "apt_one,apt_two",
+		"ARCPOINT_TOKEN_POLICY": tokenPolicyRoundRobin,
+	})
+	c.streams[0].setToken("apt_two")
+	send(c, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`)
+	send(c, `{"jsonrpc":"2.0","id":2,"method":"tools/list"}`)
+	flushOutput(t, c, out)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, got := range auth {
+		if got != "Bearer apt_two" {
+			t.Errorf("POST %d used %q, want the stream's token", i+1, got)
+		}
+	}
+}
+
+func TestRoundRobinAndFailover(t *testing.T) {
+	pool := newTokenPool([]string{"a", "b"}, tokenPolicyRoundRobin)
+	if got := []string{pool.pick(), pool.pick(), pool.pick()}; got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Errorf("round-robin picked %q", got)
+	}
+
+	pool = newTokenPool([]string{"a", "b"}, tokenPolicyFailover)
+	if got := pool.pick(); got != "a" {
+		t.Fatalf("failover started with %q", got)
+	}
+	pool.noteStatus("a", http.StatusTooManyRequests)
+	if got := pool.pick(); got != "b" {
+		t.Errorf("failover picked %q after a 429, want b", got)
+	}
+}
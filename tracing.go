@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// traceKey is the context key for a message's W3C trace context
+type traceKey struct{}
+
+// traceContext holds the W3C trace-context headers for one message
+type traceContext struct {
+	parent string
+	state  string
+}
+
+// traceID returns the trace id portion of the traceparent
+func (t traceContext) traceID() string {
+	return strings.Split(t.parent, "-")[1]
+}
+
+// withTrace attaches the trace context for msg to ctx. A traceparent the
+// host put in params._meta is propagated as-is; otherwise a new one is
+// generated when generate is set.
+func withTrace(ctx context.Context, msg rpcMessage, generate bool) context.Context {
+	var trace traceContext
+	if parent, state := msg.traceHint(); validTraceparent(parent) {
+		trace = traceContext{parent: parent, state: state}
+	} else if generate {
+		trace = traceContext{parent: newTraceparent()}
+	} else {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// traceFromContext returns the trace context attached to ctx, if any
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	trace, ok := ctx.Value(traceKey{}).(traceContext)
+	return trace, ok
+}
+
+// newTraceparent generates a sampled traceparent with random ids
+func newTraceparent() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "00-" + hex.EncodeToString(b[:16]) + "-" + hex.EncodeToString(b[16:]) + "-01"
+}
+
+// validTraceparent reports whether s is a well-formed version 00
+// traceparent, so malformed host values are never sent on
+func validTraceparent(s string) bool {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil || part != strings.ToLower(part) {
+			return false
+		}
+	}
+	return parts[1] != strings.Repeat("0", 32) && parts[2] != strings.Repeat("0", 16)
+}
+
+// serverTraceMeta holds the _meta fields a server may identify a trace by
+type serverTraceMeta struct {
+	Meta struct {
+		TraceID     interface{} `json:"traceId"`
+		Traceparent string      `json:"traceparent"`
+	} `json:"_meta"`
+}
+
+// surfaceTrace copies the trace id a server put in result._meta or
+// params._meta to a top-level arcpointTraceId field, so hosts find it in
+// the same place on every message. A _meta.traceId string is used, or
+// else the trace id of a valid _meta.traceparent. Messages without one,
+// or that already have the field, are unchanged.
+func surfaceTrace(data []byte) []byte {
+	offset := len(data) - len(bytes.TrimLeft(data, " \t\r\n"))
+	if offset == len(data) || data[offset] != '{' {
+		return data
+	}
+	if existing, _, err := fieldSpan(data, "arcpointTraceId"); err != nil || existing >= 0 {
+		return data
+	}
+
+	var traceID string
+	for _, name := range []string{"result", "params"} {
+		start, end, err := fieldSpan(data, name)
+		if err != nil || start < 0 || data[start] != '{' {
+			continue
+		}
+		var meta serverTraceMeta
+		if json.Unmarshal(data[start:end], &meta) != nil {
+			continue
+		}
+		if id, ok := meta.Meta.TraceID.(string); ok && strings.TrimSpace(id) != "" {
+			traceID = id
+		} else if validTraceparent(meta.Meta.Traceparent) {
+			traceID = traceContext{parent: meta.Meta.Traceparent}.traceID()
+		}
+		if traceID != "" {
+			break
+		}
+	}
+	if traceID == "" {
+		return data
+	}
+
+	encoded, err := marshalVerbatim(traceID)
+	if err != nil {
+		return data
+	}
+	return insertField(data, offset, append([]byte(`"arcpointTraceId":`), encoded...))
+}